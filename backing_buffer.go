@@ -5,9 +5,13 @@ import (
 	"unsafe"
 )
 
-// Backing buffer size in bytes.
+// Default backing buffer size in bytes.
 var bufferSize = os.Getpagesize()
 
+// The minimum amount of items a backing buffer may hold, so tables of big (or
+// zero-sized) items still get sane buffers.
+const minBufferSize = 16
+
 // Small and loose abstraction for the []Content.
 type backingBuffer[Content any] struct {
 	content []Content
@@ -47,6 +51,19 @@ func (b *backingBuffer[Content]) size() int {
 
 // Returns the amount of items the buffers are normally allowed to grow up to.
 func (b *PieceTable[Content]) bufferSize() int {
+	if b.options.bufferItems > 0 {
+		return b.options.bufferItems
+	}
+
+	bytes := bufferSize
+	if b.options.bufferBytes > 0 {
+		bytes = b.options.bufferBytes
+	}
+
 	var zero Content
-	return bufferSize / int(unsafe.Sizeof(zero))
+	size := int(unsafe.Sizeof(zero))
+	if size == 0 {
+		return max(bytes, minBufferSize)
+	}
+	return max(bytes/size, minBufferSize)
 }
@@ -0,0 +1,16 @@
+package gopiecetable
+
+// MarkClean marks the current state of the piece table as clean, e.g., because
+// it was just saved. New piece tables start clean.
+func (b *PieceTable[Content]) MarkClean() {
+	b.cleanRevision = b.Revision()
+}
+
+// IsDirty returns wether the piece table changed since it was last marked
+// clean. Undoing or redoing back to the clean state makes it clean again,
+// unless the edit that led to it was extended afterwards or the clean state
+// was discarded from the undo/redo list, in which case it stays dirty until
+// marked clean again.
+func (b *PieceTable[Content]) IsDirty() bool {
+	return b.Revision() != b.cleanRevision
+}
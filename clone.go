@@ -0,0 +1,36 @@
+package gopiecetable
+
+import "slices"
+
+// Clone returns an independent copy of the piece table, e.g., to make
+// speculative edits and then either discard the copy or keep it in place of
+// the original. The buffers are shared, as what's in them never changes: the
+// original keeps appending to its add buffer in place, while the copy copies
+// it on its first append. Therefore, cloning only copies the pieces and the
+// undo/redo list.
+//
+// The first edit made on the copy is never merged into the last one made
+// before cloning, and the copy does not write to the journal set with
+// WithJournal, if any.
+func (b *PieceTable[Content]) Clone() *PieceTable[Content] {
+	c := *b
+	c.buffers = slices.Clone(b.buffers)
+	c.freezeAddBuffer()
+	c.pieces = slices.Clone(b.pieces)
+	c.edits = slices.Clone(b.edits)
+	c.calls = slices.Clone(b.calls)
+	// Edits made on the copy are never merged into the ones made before.
+	c.coalescing = false
+	c.options.journal = nil
+	c.journalErr = nil
+	c.lines = nil
+	return &c
+}
+
+// Makes the next append to the add buffer reallocate it, so the items appended
+// are not seen by the piece tables sharing it, which only read up to its
+// current length.
+func (b *PieceTable[Content]) freezeAddBuffer() {
+	last := &b.buffers[len(b.buffers)-1]
+	last.content = slices.Clip(last.content)
+}
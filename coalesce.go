@@ -0,0 +1,175 @@
+package gopiecetable
+
+import (
+	"time"
+	"unicode"
+)
+
+// Coalescing describes an insertion or deletion of a single item that may be
+// merged into the last edit, which is of the same kind and adjacent to it.
+type Coalescing[Content any] struct {
+	// The last edit, as it would be redone.
+	Last EditInfo
+	// Where the item is inserted or deleted. For insertions, it's always
+	// Last.End(). For deletions, it's Last.Start-1 when deleting backwards
+	// (backspace) and Last.Start when deleting forwards.
+	Index int
+	// The item inserted or deleted.
+	Item Content
+	// The item inserted or deleted by the previous call to Insert or Delete,
+	// which was merged into the last edit.
+	Previous Content
+	// Time since the last edit was made or extended.
+	Elapsed time.Duration
+}
+
+// Backwards returns wether a deletion is made backwards, i.e., it's deleting
+// the item right before the last edit.
+func (c Coalescing[Content]) Backwards() bool {
+	return c.Index == c.Last.Start-1
+}
+
+// CoalescePolicy decides wether insertions and deletions are merged into the
+// last edit, so they're undone and redone together. Set it with
+// SetCoalescePolicy.
+type CoalescePolicy[Content any] interface {
+	Coalesce(c Coalescing[Content]) bool
+}
+
+// CoalesceFunc is a function implementing CoalescePolicy.
+type CoalesceFunc[Content any] func(c Coalescing[Content]) bool
+
+func (f CoalesceFunc[Content]) Coalesce(c Coalescing[Content]) bool {
+	return f(c)
+}
+
+// DefaultCoalescing returns the policy used by default: insertions made
+// left-to-right (the common way of typing) and deletions made right-to-left
+// (the usual way with the backspace key) are merged, others are not.
+func DefaultCoalescing[Content any]() CoalescePolicy[Content] {
+	return CoalesceFunc[Content](func(c Coalescing[Content]) bool {
+		return c.Last.Kind == KindInsertion || c.Backwards()
+	})
+}
+
+// NoCoalescing returns a policy that never merges edits, so every insertion
+// and deletion is undone on its own.
+func NoCoalescing[Content any]() CoalescePolicy[Content] {
+	return CoalesceFunc[Content](func(c Coalescing[Content]) bool {
+		return false
+	})
+}
+
+// ForwardDeletes returns a policy that merges deletions made left-to-right
+// (the usual way with the delete key) and defers everything else to p.
+func ForwardDeletes[Content any](
+	p CoalescePolicy[Content],
+) CoalescePolicy[Content] {
+	return CoalesceFunc[Content](func(c Coalescing[Content]) bool {
+		if c.Last.Kind == KindDeletion && !c.Backwards() {
+			return true
+		}
+		return p.Coalesce(c)
+	})
+}
+
+// TimeWindow returns a policy that only merges what p merges if the last edit
+// was made or extended at most d ago, so pausing starts a new edit.
+func TimeWindow[Content any](
+	d time.Duration,
+	p CoalescePolicy[Content],
+) CoalescePolicy[Content] {
+	return CoalesceFunc[Content](func(c Coalescing[Content]) bool {
+		return c.Elapsed <= d && p.Coalesce(c)
+	})
+}
+
+// WordBoundaries returns a policy for PieceTable[rune] that only merges what p
+// merges if the edit does not cross a word boundary, i.e., typing or deleting
+// a white space after something else starts a new edit, like most editors do.
+func WordBoundaries(p CoalescePolicy[rune]) CoalescePolicy[rune] {
+	return CoalesceFunc[rune](func(c Coalescing[rune]) bool {
+		if unicode.IsSpace(c.Item) && !unicode.IsSpace(c.Previous) {
+			return false
+		}
+		return p.Coalesce(c)
+	})
+}
+
+// SetCoalescePolicy sets the policy that decides wether insertions and
+// deletions are merged into the last edit. Nil restores DefaultCoalescing.
+func (b *PieceTable[Content]) SetCoalescePolicy(p CoalescePolicy[Content]) {
+	b.coalescePolicy = p
+}
+
+// Returns wether an insertion or deletion of item at idx, of the given kind,
+// should be merged into the last edit.
+func (b *PieceTable[Content]) coalesces(
+	kind EditKind,
+	idx int,
+	item Content,
+) bool {
+	if !b.coalescing || b.undoTop == 0 {
+		return false
+	}
+
+	policy := b.coalescePolicy
+	if b.replaying != nil || b.mergeNext {
+		// Merged as it was when recorded, or always if forced.
+		merged := b.mergeNext || b.replaying.Merged
+		policy = CoalesceFunc[Content](func(Coalescing[Content]) bool {
+			return merged
+		})
+	}
+	last := b.edits[b.undoTop-1]
+	return coalesces(
+		policy,
+		kind,
+		last.info(),
+		last.lastChanged(),
+		idx,
+		item,
+		b.lastItem,
+	)
+}
+
+// Returns wether an insertion or deletion of item at idx, of the given kind,
+// should be merged into the last edit, made or extended at changed, which is
+// only asked to the policy (DefaultCoalescing if nil) if they're of the same
+// kind and adjacent. The previous item is the one inserted or deleted by the
+// last action. Shared by PieceTable and GapBuffer, so they merge the same
+// edits.
+func coalesces[Content any](
+	policy CoalescePolicy[Content],
+	kind EditKind,
+	last EditInfo,
+	changed time.Time,
+	idx int,
+	item Content,
+	previous Content,
+) bool {
+	if last.Kind != kind {
+		return false
+	}
+	switch kind {
+	case KindInsertion:
+		if idx != last.End() {
+			return false
+		}
+	case KindDeletion:
+		if idx != last.Start && idx != last.Start-1 {
+			return false
+		}
+	}
+
+	if policy == nil {
+		policy = DefaultCoalescing[Content]()
+	}
+	return policy.Coalesce(Coalescing[Content]{
+		Last:     last,
+		Index:    idx,
+		Item:     item,
+		Previous: previous,
+		Elapsed:  time.Since(changed),
+	})
+}
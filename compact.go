@@ -0,0 +1,167 @@
+package gopiecetable
+
+import (
+	"slices"
+	"unsafe"
+)
+
+// A run of items in the old buffers that's still referenced by some piece,
+// and where it's going to live after compacting.
+type run struct {
+	oldStart int // The start in the old buffers, as if they were concatenated.
+	newStart int // The start in the new buffer.
+	length   int
+}
+
+// Compact rewrites the buffers keeping only the items referenced by the
+// current pieces or by the undo/redo list, dropping everything else. Returns
+// the amount of bytes reclaimed, which may be negative if there was nothing to
+// drop.
+//
+// The buffers are only ever appended to, so content deleted long ago and
+// discarded from the undo list (see TrimHistory) stays in memory until the
+// piece table is compacted.
+func (b *PieceTable[Content]) Compact() int {
+	var zero Content
+	oldCap := 0
+	for _, buf := range b.buffers {
+		oldCap += cap(buf.content)
+	}
+
+	// Where each buffer begins as if they were concatenated.
+	offsets := make([]int, len(b.buffers))
+	for i := 1; i < len(b.buffers); i++ {
+		offsets[i] = offsets[i-1] + b.buffers[i-1].size()
+	}
+
+	runs := b.referencedRuns(offsets)
+
+	// We leave a hole between runs so pieces that were not contiguous don't
+	// become so.
+	size := 0
+	for i := range runs {
+		if i > 0 {
+			size++
+		}
+		runs[i].newStart = size
+		size += runs[i].length
+	}
+
+	compacted := newBackingBuffer[Content](size)
+	for i, r := range runs {
+		if i > 0 {
+			compacted.append(zero)
+		}
+		buf, disp := b.bufferByOffset(offsets, r.oldStart)
+		for range r.length {
+			for disp >= b.buffers[buf].size() {
+				disp = 0
+				buf++
+			}
+			compacted.append(b.buffers[buf].content[disp])
+			disp++
+		}
+	}
+
+	// The spans of the edits may be shared with clones, so the pieces are
+	// relocated into new slices.
+	relocate := func(pieces []piece) []piece {
+		relocated := make([]piece, len(pieces))
+		for i, p := range pieces {
+			old := offsets[p.buffer] + p.start
+			r := runs[b.runWith(runs, old)]
+			relocated[i] = piece{
+				buffer: 0,
+				start:  r.newStart + old - r.oldStart,
+				length: p.length,
+			}
+		}
+		return relocated
+	}
+
+	b.pieces = relocate(b.pieces)
+	for i, e := range b.edits {
+		s := e.changes()
+		s.before = relocate(s.before)
+		s.after = relocate(s.after)
+		b.edits[i] = e.withChanges(s)
+	}
+
+	b.buffers = []backingBuffer[Content]{
+		compacted,
+		newBackingBuffer[Content](b.bufferSize()),
+	}
+
+	b.discarded = 0
+	b.epoch++
+	newCap := size + b.bufferSize()
+	return (oldCap - newCap) * int(unsafe.Sizeof(zero))
+}
+
+// Returns the sorted runs of items referenced by any piece, given the offsets
+// of the buffers. Overlapping and touching runs are merged.
+func (b *PieceTable[Content]) referencedRuns(offsets []int) []run {
+	var runs []run
+	add := func(pieces []piece) {
+		for _, p := range pieces {
+			runs = append(runs, run{
+				oldStart: offsets[p.buffer] + p.start,
+				length:   p.length,
+			})
+		}
+	}
+
+	add(b.pieces)
+	for _, e := range b.edits {
+		s := e.changes()
+		add(s.before)
+		add(s.after)
+	}
+
+	slices.SortFunc(runs, func(a, b run) int {
+		return a.oldStart - b.oldStart
+	})
+
+	merged := runs[:0]
+	for _, r := range runs {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if r.oldStart <= last.oldStart+last.length {
+				end := max(last.oldStart+last.length, r.oldStart+r.length)
+				last.length = end - last.oldStart
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// Returns the index of the run containing the old offset.
+func (b *PieceTable[Content]) runWith(runs []run, offset int) int {
+	i, _ := slices.BinarySearchFunc(runs, offset, func(r run, o int) int {
+		return r.oldStart - o
+	})
+	if i == len(runs) || runs[i].oldStart > offset {
+		i--
+	}
+	return i
+}
+
+// Returns the buffer and displacement of an offset as if the buffers were
+// concatenated.
+func (b *PieceTable[Content]) bufferByOffset(
+	offsets []int,
+	offset int,
+) (buffer int, bdisp int) {
+	i, found := slices.BinarySearch(offsets, offset)
+	if !found {
+		i--
+	}
+	// Skip empty buffers.
+	for i+1 < len(offsets) && offsets[i+1] == offset {
+		i++
+	}
+	return i, offset - offsets[i]
+}
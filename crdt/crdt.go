@@ -0,0 +1,238 @@
+// Package crdt implements collaborative editing on top of piece tables with a
+// replicated growable array (RGA), a sequence CRDT.
+//
+// Each replica keeps a piece table and the identity of every item ever
+// inserted, including deleted ones (tombstones). Local edits are applied to the
+// piece table and yield operations to send to the other replicas, which
+// integrate them in any order, possibly more than once, and converge to the
+// same content.
+package crdt
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/gboncoffee/gopiecetable"
+)
+
+// ID identifies an inserted item across all replicas.
+type ID struct {
+	Counter uint64 // Lamport timestamp of the insertion.
+	Replica uint64 // The replica that inserted it.
+}
+
+// The zero ID is the beggining of the sequence.
+var head ID
+
+// Returns wether the ID a wins over b, i.e., an item inserted with a goes
+// before one inserted with b right after the same item.
+func (a ID) greater(b ID) bool {
+	if a.Counter != b.Counter {
+		return a.Counter > b.Counter
+	}
+	return a.Replica > b.Replica
+}
+
+// Kind tells wether an operation inserts or deletes.
+type Kind int
+
+const (
+	Insert Kind = iota
+	Delete
+)
+
+// Op is an operation to be sent to other replicas.
+type Op[Content any] struct {
+	Kind Kind
+	// For insertions, the ID of the new item. For deletions, the ID of the
+	// deleted item.
+	ID ID
+	// For insertions, the ID of the item the new one was inserted right
+	// after, or the zero ID for the beggining.
+	After ID
+	// For insertions, the item.
+	Value Content
+}
+
+// Returned when an operation depends on an item the replica doesn't know.
+var ErrorMissingDependency = errors.New("missing dependency")
+
+// An item, possibly deleted.
+type element struct {
+	id      ID
+	deleted bool
+}
+
+// Replica is a replica of a sequence, backed by a piece table. The piece table
+// must only be edited through the replica.
+type Replica[Content any] struct {
+	id       uint64
+	clock    uint64
+	table    *gopiecetable.PieceTable[Content]
+	elements []element
+	known    map[ID]bool
+	// Operations waiting for their dependencies.
+	pending []Op[Content]
+}
+
+// NewReplica returns an empty replica with the given ID, which must be unique
+// among the replicas and not zero.
+func NewReplica[Content any](
+	id uint64,
+	opts ...gopiecetable.Option,
+) *Replica[Content] {
+	return &Replica[Content]{
+		id:    id,
+		table: gopiecetable.New[Content](opts...),
+		known: map[ID]bool{head: true},
+	}
+}
+
+// Table returns the piece table of the replica. It must not be edited
+// directly.
+func (r *Replica[Content]) Table() *gopiecetable.PieceTable[Content] {
+	return r.table
+}
+
+// Insert inserts v at the index idx, returning the operation to send to the
+// other replicas.
+func (r *Replica[Content]) Insert(idx int, v Content) (Op[Content], error) {
+	pos, err := r.position(idx)
+	if err != nil {
+		return Op[Content]{}, err
+	}
+
+	after := head
+	if pos > 0 {
+		after = r.elements[pos-1].id
+	}
+	r.clock++
+	op := Op[Content]{
+		Kind:  Insert,
+		ID:    ID{Counter: r.clock, Replica: r.id},
+		After: after,
+		Value: v,
+	}
+	r.integrate(op)
+	return op, nil
+}
+
+// Delete deletes the item at the index idx, returning the operation to send to
+// the other replicas.
+func (r *Replica[Content]) Delete(idx int) (Op[Content], error) {
+	if idx < 0 || idx >= r.table.Size() {
+		return Op[Content]{}, gopiecetable.ErrorOutOfBounds
+	}
+	pos, _ := r.position(idx)
+	// Skip the tombstones before the item.
+	for r.elements[pos].deleted {
+		pos++
+	}
+
+	op := Op[Content]{Kind: Delete, ID: r.elements[pos].id}
+	r.integrate(op)
+	return op, nil
+}
+
+// Apply integrates an operation from another replica. Operations may arrive in
+// any order and more than once: the ones whose dependencies are not known yet
+// are kept until they are.
+func (r *Replica[Content]) Apply(op Op[Content]) {
+	r.pending = append(r.pending, op)
+	for progress := true; progress; {
+		progress = false
+		for i := 0; i < len(r.pending); i++ {
+			if r.ready(r.pending[i]) {
+				op := r.pending[i]
+				r.pending = slices.Delete(r.pending, i, i+1)
+				r.integrate(op)
+				progress = true
+				i--
+			}
+		}
+	}
+}
+
+// Pending returns the amount of operations waiting for their dependencies.
+func (r *Replica[Content]) Pending() int {
+	return len(r.pending)
+}
+
+// Returns wether the dependencies of the operation are known.
+func (r *Replica[Content]) ready(op Op[Content]) bool {
+	switch op.Kind {
+	case Insert:
+		return r.known[op.After]
+	default:
+		return r.known[op.ID]
+	}
+}
+
+// Integrates an operation whose dependencies are known, applying it to the
+// piece table.
+func (r *Replica[Content]) integrate(op Op[Content]) {
+	switch op.Kind {
+	case Insert:
+		if r.known[op.ID] {
+			return
+		}
+		r.clock = max(r.clock, op.ID.Counter)
+
+		pos := 0
+		if op.After != head {
+			pos = r.find(op.After) + 1
+		}
+		// Concurrent insertions after the same item with greater IDs go
+		// first, and so do the items inserted after them, which all have
+		// greater IDs too.
+		for pos < len(r.elements) && r.elements[pos].id.greater(op.ID) {
+			pos++
+		}
+
+		r.elements = slices.Insert(r.elements, pos, element{id: op.ID})
+		r.known[op.ID] = true
+		r.table.Insert(r.visible(pos), op.Value)
+
+	case Delete:
+		pos := r.find(op.ID)
+		if r.elements[pos].deleted {
+			return
+		}
+		r.elements[pos].deleted = true
+		r.table.Delete(r.visible(pos))
+	}
+}
+
+// Returns the position in the elements of the item with the given ID.
+func (r *Replica[Content]) find(id ID) int {
+	return slices.IndexFunc(r.elements, func(e element) bool {
+		return e.id == id
+	})
+}
+
+// Returns the index in the piece table of the element at pos, i.e., the amount
+// of elements before it that are not deleted.
+func (r *Replica[Content]) visible(pos int) int {
+	idx := 0
+	for _, e := range r.elements[:pos] {
+		if !e.deleted {
+			idx++
+		}
+	}
+	return idx
+}
+
+// Returns the position in the elements where an item inserted at the index idx
+// of the piece table goes, i.e., right after the idx-th element not deleted.
+func (r *Replica[Content]) position(idx int) (int, error) {
+	if idx < 0 || idx > r.table.Size() {
+		return 0, gopiecetable.ErrorOutOfBounds
+	}
+	pos := 0
+	for seen := 0; seen < idx; pos++ {
+		if !r.elements[pos].deleted {
+			seen++
+		}
+	}
+	return pos, nil
+}
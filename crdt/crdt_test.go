@@ -0,0 +1,178 @@
+package crdt
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/gboncoffee/gopiecetable"
+)
+
+// Delivers operations between replicas in memory, in a random order and
+// sometimes more than once.
+type helperNetwork struct {
+	replicas []*Replica[rune]
+	// The operations in flight to each replica.
+	inboxes [][]Op[rune]
+	rng     *rand.Rand
+}
+
+func helperNewNetwork(n int, rng *rand.Rand) *helperNetwork {
+	net := &helperNetwork{inboxes: make([][]Op[rune], n), rng: rng}
+	for i := range n {
+		net.replicas = append(net.replicas, NewReplica[rune](uint64(i+1)))
+	}
+	return net
+}
+
+func (net *helperNetwork) broadcast(from int, op Op[rune]) {
+	for i := range net.inboxes {
+		if i == from {
+			continue
+		}
+		net.inboxes[i] = append(net.inboxes[i], op)
+		if net.rng.IntN(10) == 0 {
+			net.inboxes[i] = append(net.inboxes[i], op)
+		}
+	}
+}
+
+// Delivers some random operations in flight.
+func (net *helperNetwork) deliverSome() {
+	for i, inbox := range net.inboxes {
+		net.rng.Shuffle(len(inbox), func(x, y int) {
+			inbox[x], inbox[y] = inbox[y], inbox[x]
+		})
+		n := net.rng.IntN(len(inbox) + 1)
+		for _, op := range inbox[:n] {
+			net.replicas[i].Apply(op)
+		}
+		net.inboxes[i] = inbox[n:]
+	}
+}
+
+func (net *helperNetwork) deliverAll() {
+	for i, inbox := range net.inboxes {
+		net.rng.Shuffle(len(inbox), func(x, y int) {
+			inbox[x], inbox[y] = inbox[y], inbox[x]
+		})
+		for _, op := range inbox {
+			net.replicas[i].Apply(op)
+		}
+		net.inboxes[i] = nil
+	}
+}
+
+func helperTestConverged(t *testing.T, net *helperNetwork) {
+	t.Helper()
+	expected := gopiecetable.String(net.replicas[0].Table())
+	for i, r := range net.replicas {
+		if r.Pending() != 0 {
+			t.Fatalf("replica %v has %v pending operations", i, r.Pending())
+		}
+		if s := gopiecetable.String(r.Table()); s != expected {
+			t.Fatalf("replica %v has %q, replica 0 has %q", i, s, expected)
+		}
+	}
+}
+
+func TestLocalEdits(t *testing.T) {
+	r := NewReplica[rune](1)
+	for i, c := range "hello" {
+		if _, err := r.Insert(i, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Delete(0)
+	r.Insert(0, 'j')
+	if s := gopiecetable.String(r.Table()); s != "jello" {
+		t.Fatalf("expected %q, got %q", "jello", s)
+	}
+
+	if _, err := r.Insert(7, 'x'); err == nil {
+		t.Fatal("inserting out of bounds did not fail")
+	}
+	if _, err := r.Delete(5); err == nil {
+		t.Fatal("deleting out of bounds did not fail")
+	}
+}
+
+func TestConcurrentInsertions(t *testing.T) {
+	net := helperNewNetwork(2, rand.New(rand.NewPCG(1, 2)))
+	a, b := net.replicas[0], net.replicas[1]
+
+	for i, c := range "ac" {
+		op, _ := a.Insert(i, c)
+		net.broadcast(0, op)
+	}
+	net.deliverAll()
+
+	// Both insert between 'a' and 'c' at the same time.
+	op, _ := a.Insert(1, 'b')
+	net.broadcast(0, op)
+	op, _ = b.Insert(1, 'B')
+	net.broadcast(1, op)
+	// And one deletes 'c' while the other inserts after it.
+	op, _ = a.Delete(2)
+	net.broadcast(0, op)
+	op, _ = b.Insert(3, 'd')
+	net.broadcast(1, op)
+
+	net.deliverAll()
+	helperTestConverged(t, net)
+	if s := gopiecetable.String(a.Table()); s != "aBbd" {
+		t.Fatalf("expected %q, got %q", "aBbd", s)
+	}
+}
+
+func TestOutOfOrderDelivery(t *testing.T) {
+	a := NewReplica[rune](1)
+	b := NewReplica[rune](2)
+
+	var ops []Op[rune]
+	for i, c := range "abc" {
+		op, _ := a.Insert(i, c)
+		ops = append(ops, op)
+	}
+	op, _ := a.Delete(1)
+	ops = append(ops, op)
+
+	for i := len(ops) - 1; i >= 0; i-- {
+		b.Apply(ops[i])
+	}
+	if b.Pending() != 0 {
+		t.Fatalf("%v operations still pending", b.Pending())
+	}
+	if s := gopiecetable.String(b.Table()); s != "ac" {
+		t.Fatalf("expected %q, got %q", "ac", s)
+	}
+}
+
+func TestRandomConvergence(t *testing.T) {
+	rng := rand.New(rand.NewPCG(420, 69))
+	net := helperNewNetwork(4, rng)
+
+	for range 2000 {
+		i := rng.IntN(len(net.replicas))
+		r := net.replicas[i]
+		size := r.Table().Size()
+
+		var op Op[rune]
+		var err error
+		if size > 0 && rng.IntN(5) < 2 {
+			op, err = r.Delete(rng.IntN(size))
+		} else {
+			op, err = r.Insert(rng.IntN(size+1), 'a'+rune(rng.IntN(26)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		net.broadcast(i, op)
+
+		if rng.IntN(20) == 0 {
+			net.deliverSome()
+		}
+	}
+
+	net.deliverAll()
+	helperTestConverged(t, net)
+}
@@ -0,0 +1,415 @@
+package gopiecetable
+
+import (
+	"slices"
+	"unicode/utf8"
+)
+
+// Hunk is a region where two sequences differ: the items in
+// [AStart, AStart+ALength) of the first are replaced by the items in
+// [BStart, BStart+BLength) of the second.
+type Hunk struct {
+	AStart  int
+	ALength int
+	BStart  int
+	BLength int
+}
+
+// Diff returns the hunks that turn the content of the snapshot a into the
+// content of the snapshot b, in order.
+//
+// If both snapshots were taken from the same piece table, the regions where
+// they share the pieces are skipped without comparing the content, so only
+// what changed between them is diffed with the Myers algorithm. Runes are
+// diffed by lines first, and then only inside the lines that changed. Regions
+// that changed too much to be diffed quickly are split and diffed in parts, so
+// the hunks may not be minimal.
+func Diff[Content comparable](a, b Snapshot[Content]) []Hunk {
+	var hunks []Hunk
+	aview, bview := a.view(), b.view()
+	// Diffs the gap between the shared runs.
+	gap := func(aStart, aEnd, bStart, bEnd int) {
+		for _, h := range diff(
+			aview.slice(aStart, aEnd),
+			bview.slice(bStart, bEnd),
+		) {
+			h.AStart += aStart
+			h.BStart += bStart
+			hunks = append(hunks, h)
+		}
+	}
+
+	aPos, bPos := 0, 0
+	for _, r := range sharedRuns(a, b) {
+		gap(aPos, r.aStart, bPos, r.bStart)
+		aPos, bPos = r.aStart+r.length, r.bStart+r.length
+	}
+	gap(aPos, a.size, bPos, b.size)
+	return hunks
+}
+
+// A run of items shared by two snapshots, i.e., the same items in the same
+// buffers.
+type sharedRun struct {
+	aStart int
+	bStart int
+	length int
+}
+
+// Where the items of a part of a piece are in the buffers and in the content.
+// Parts never span buffers.
+type piecePart struct {
+	buffer int
+	start  int
+	length int
+	pos    int
+}
+
+// Returns the parts of the pieces of the snapshot, in order.
+func (s Snapshot[Content]) parts() []piecePart {
+	view := s.view()
+	parts := make([]piecePart, 0, len(s.pieces))
+	pos := 0
+	for _, p := range s.pieces {
+		buf, start := view.indexByPiece(p, 0)
+		for n := p.length; n > 0; buf++ {
+			m := min(view.buffers[buf].size()-start, n)
+			parts = append(parts, piecePart{buf, start, m, pos})
+			pos += m
+			n -= m
+			start = 0
+		}
+	}
+	return parts
+}
+
+// Returns the runs of items shared by the snapshots, in order, found by
+// walking their pieces, or nil if they don't share buffers. Items are never
+// moved, only deleted and inserted as new ones, so the items of a shared by b
+// are in the same order in both.
+func sharedRuns[Content any](a, b Snapshot[Content]) []sharedRun {
+	if !a.sharesBuffers(b) {
+		return nil
+	}
+
+	aparts := a.parts()
+	// Sorted by where they are in the buffers, to find the ones with the
+	// items of each part of a.
+	bparts := b.parts()
+	slices.SortFunc(bparts, func(x, y piecePart) int {
+		if x.buffer != y.buffer {
+			return x.buffer - y.buffer
+		}
+		return x.start - y.start
+	})
+
+	var runs []sharedRun
+	for _, ap := range aparts {
+		// The first part of b ending after ap starts.
+		i, _ := slices.BinarySearchFunc(
+			bparts,
+			ap,
+			func(bp, ap piecePart) int {
+				if bp.buffer != ap.buffer {
+					return bp.buffer - ap.buffer
+				}
+				return bp.start + bp.length - 1 - ap.start
+			},
+		)
+		for ; i < len(bparts); i++ {
+			bp := bparts[i]
+			if bp.buffer != ap.buffer || bp.start >= ap.start+ap.length {
+				break
+			}
+			from := max(ap.start, bp.start)
+			to := min(ap.start+ap.length, bp.start+bp.length)
+			r := sharedRun{
+				aStart: ap.pos + from - ap.start,
+				bStart: bp.pos + from - bp.start,
+				length: to - from,
+			}
+
+			if n := len(runs); n > 0 {
+				last := &runs[n-1]
+				// Shouldn't happen, but the runs must be in order in both.
+				if r.bStart < last.bStart+last.length {
+					continue
+				}
+				if r.aStart == last.aStart+last.length &&
+					r.bStart == last.bStart+last.length {
+					last.length += r.length
+					continue
+				}
+			}
+			runs = append(runs, r)
+		}
+	}
+	return runs
+}
+
+// Returns the length of the prefix and suffix of the snapshots that are made
+// of the same items in the same buffers. Both are zero if the snapshots don't
+// share buffers. The prefix and suffix never overlap.
+func sharedAffixes[Content any](a, b Snapshot[Content]) (prefix, suffix int) {
+	if !a.sharesBuffers(b) {
+		return 0, 0
+	}
+	// The pieces of each snapshot are resolved with its own buffers, as b
+	// may have been taken after new buffers were allocated, or before.
+	aview, bview := a.view(), b.view()
+
+	// Walks the pieces from the beggining while they point to the same items.
+	i, j := 0, 0
+	ad, bd := 0, 0 // Displacements inside the pieces.
+	for i < len(a.pieces) && j < len(b.pieces) {
+		ap, bp := a.pieces[i], b.pieces[j]
+		abuf, adisp := aview.indexByPiece(ap, ad)
+		bbuf, bdisp := bview.indexByPiece(bp, bd)
+		if abuf != bbuf || adisp != bdisp {
+			break
+		}
+
+		n := min(ap.length-ad, bp.length-bd)
+		prefix += n
+		ad += n
+		bd += n
+		if ad == ap.length {
+			i++
+			ad = 0
+		}
+		if bd == bp.length {
+			j++
+			bd = 0
+		}
+	}
+
+	// Now from the end, with the displacements counting from the end of the
+	// pieces.
+	limit := min(a.size, b.size) - prefix
+	i, j = len(a.pieces)-1, len(b.pieces)-1
+	ad, bd = 0, 0
+	for i >= 0 && j >= 0 && suffix < limit {
+		ap, bp := a.pieces[i], b.pieces[j]
+		abuf, adisp := aview.indexByPiece(ap, ap.length-1-ad)
+		bbuf, bdisp := bview.indexByPiece(bp, bp.length-1-bd)
+		if abuf != bbuf || adisp != bdisp {
+			break
+		}
+
+		n := min(ap.length-ad, bp.length-bd, limit-suffix)
+		suffix += n
+		ad += n
+		bd += n
+		if ad == ap.length {
+			i--
+			ad = 0
+		}
+		if bd == bp.length {
+			j--
+			bd = 0
+		}
+	}
+
+	return prefix, suffix
+}
+
+// Returns a copy of the items in [start, end), which must be in bounds.
+func (b *PieceTable[Content]) slice(start, end int) []Content {
+	content, _ := b.Slice(start, end)
+	return content
+}
+
+// Above this many insertions and deletions, the shortest path through a
+// region is not searched any further. The region is split at the furthest
+// point reached instead, and each side is diffed on its own, so regions that
+// changed a lot take neither too long nor too much memory, at the cost of a
+// diff that may not be minimal.
+const myersMaxCost = 512
+
+// Returns the hunks that turn a into b, using the linear space variant of the
+// Myers algorithm.
+func myers[T comparable](a, b []T) []Hunk {
+	d := differ[T]{a: a, b: b}
+	d.compare(0, len(a), 0, len(b))
+	return d.hunks
+}
+
+// Returns the hunks that turn a into b. Runes are diffed by lines first, and
+// then rune by rune only inside the lines that changed, so changes scattered
+// over the whole content, like the line terminators of every line, are found
+// one by one instead of as a single region.
+func diff[T comparable](a, b []T) []Hunk {
+	ar, ok := any(a).([]rune)
+	if !ok {
+		return myers(a, b)
+	}
+	br := any(b).([]rune)
+	// The lines are compared as strings, which can't hold invalid runes.
+	invalid := func(r rune) bool { return !utf8.ValidRune(r) }
+	if slices.ContainsFunc(ar, invalid) || slices.ContainsFunc(br, invalid) {
+		return myers(a, b)
+	}
+
+	aLines, bLines := splitLines(ar), splitLines(br)
+	aPos, bPos := linePositions(aLines), linePositions(bLines)
+	var hunks []Hunk
+	for _, lh := range myers(aLines, bLines) {
+		aStart, bStart := aPos[lh.AStart], bPos[lh.BStart]
+		aEnd := aPos[lh.AStart+lh.ALength]
+		bEnd := bPos[lh.BStart+lh.BLength]
+		for _, h := range myers(ar[aStart:aEnd], br[bStart:bEnd]) {
+			h.AStart += aStart
+			h.BStart += bStart
+			hunks = append(hunks, h)
+		}
+	}
+	return hunks
+}
+
+// Returns where each line starts, in runes, followed by where the last one
+// ends.
+func linePositions(lines []string) []int {
+	positions := make([]int, len(lines)+1)
+	for i, line := range lines {
+		positions[i+1] = positions[i] + utf8.RuneCountInString(line)
+	}
+	return positions
+}
+
+// The state of a diff. The furthest reaching paths are reused between the
+// regions, as they're compared one at a time.
+type differ[T comparable] struct {
+	a, b    []T
+	forward []int // The furthest x reached in each diagonal, from the start.
+	reverse []int // The same, from the end, counting backwards.
+	hunks   []Hunk
+}
+
+// Appends the hunks that turn a[aStart:aEnd] into b[bStart:bEnd], dividing it
+// in smaller regions around a snake (a diagonal of equal items) in the middle
+// of the shortest path.
+func (d *differ[T]) compare(aStart, aEnd, bStart, bEnd int) {
+	for aStart < aEnd && bStart < bEnd && d.a[aStart] == d.b[bStart] {
+		aStart++
+		bStart++
+	}
+	for aStart < aEnd && bStart < bEnd && d.a[aEnd-1] == d.b[bEnd-1] {
+		aEnd--
+		bEnd--
+	}
+
+	if aStart == aEnd || bStart == bEnd {
+		d.replace(aStart, aEnd, bStart, bEnd)
+		return
+	}
+
+	x, y, u, v, ok := d.middleSnake(aStart, aEnd, bStart, bEnd)
+	if !ok {
+		d.replace(aStart, aEnd, bStart, bEnd)
+		return
+	}
+	d.compare(aStart, x, bStart, y)
+	d.compare(u, aEnd, v, bEnd)
+}
+
+// Appends a hunk replacing a[aStart:aEnd] with b[bStart:bEnd], merging it
+// into the last one if they touch.
+func (d *differ[T]) replace(aStart, aEnd, bStart, bEnd int) {
+	if aStart == aEnd && bStart == bEnd {
+		return
+	}
+	if len(d.hunks) > 0 {
+		last := &d.hunks[len(d.hunks)-1]
+		if last.AStart+last.ALength == aStart &&
+			last.BStart+last.BLength == bStart {
+			last.ALength += aEnd - aStart
+			last.BLength += bEnd - bStart
+			return
+		}
+	}
+	d.hunks = append(d.hunks, Hunk{
+		AStart:  aStart,
+		ALength: aEnd - aStart,
+		BStart:  bStart,
+		BLength: bEnd - bStart,
+	})
+}
+
+// Returns the snake from (x, y) to (u, v) in the middle of a shortest path
+// from (aStart, bStart) to (aEnd, bEnd), searching from both ends at once.
+// If the path costs more than myersMaxCost, returns instead the furthest
+// point reached from the start as an empty snake. Returns false if there's no
+// such point besides the ends of the region.
+func (d *differ[T]) middleSnake(
+	aStart, aEnd, bStart, bEnd int,
+) (x, y, u, v int, ok bool) {
+	n, m := aEnd-aStart, bEnd-bStart
+	delta := n - m
+	odd := delta%2 != 0
+	steps := min((n+m+1)/2, myersMaxCost/2)
+
+	// The diagonals k = x - y go from -steps-1 to steps+1, offset by off.
+	off := steps + 1
+	if size := 2*off + 1; len(d.forward) < size {
+		d.forward = make([]int, size)
+		d.reverse = make([]int, size)
+	}
+	d.forward[off+1] = 0
+	d.reverse[off+1] = 0
+	bestX, bestY := 0, 0
+
+	for step := 0; step <= steps; step++ {
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || (k != step && d.forward[off+k-1] <
+				d.forward[off+k+1]) {
+				x = d.forward[off+k+1] // Down, i.e., inserting.
+			} else {
+				x = d.forward[off+k-1] + 1 // Right, i.e., deleting.
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && d.a[aStart+x] == d.b[bStart+y] {
+				x++
+				y++
+			}
+			d.forward[off+k] = x
+			if x <= n && y <= m && x+y > bestX+bestY {
+				bestX, bestY = x, y
+			}
+
+			// The reverse search made one step less. Its diagonals are
+			// mirrored, i.e., the diagonal k is delta-k from the end.
+			if r := delta - k; odd && r >= -(step-1) && r <= step-1 &&
+				x+d.reverse[off+r] >= n {
+				return aStart + sx, bStart + sy, aStart + x, bStart + y, true
+			}
+		}
+
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || (k != step && d.reverse[off+k-1] <
+				d.reverse[off+k+1]) {
+				x = d.reverse[off+k+1]
+			} else {
+				x = d.reverse[off+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m &&
+				d.a[aEnd-1-x] == d.b[bEnd-1-y] {
+				x++
+				y++
+			}
+			d.reverse[off+k] = x
+
+			if f := delta - k; !odd && f >= -step && f <= step &&
+				x+d.forward[off+f] >= n {
+				return aEnd - x, bEnd - y, aEnd - sx, bEnd - sy, true
+			}
+		}
+	}
+	x, y = aStart+bestX, bStart+bestY
+	ok = (bestX != 0 || bestY != 0) && (bestX != n || bestY != m)
+	return x, y, x, y, ok
+}
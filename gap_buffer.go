@@ -0,0 +1,279 @@
+package gopiecetable
+
+import (
+	"iter"
+	"slices"
+	"time"
+)
+
+// The minimum size of the gap when the gap buffer grows.
+const minGapSize = 64
+
+// GapBuffer is a gap buffer: the items are kept in a single array with a gap
+// where the last edit was made, so edits close to each other are cheap, but
+// moving the gap far away copies everything in between. It has the same
+// undo/redo behaviour as PieceTable, including the coalescing policies.
+//
+// It's simpler and faster than a piece table for small content edited in one
+// place at a time, but the edits store the items they removed.
+type GapBuffer[Content any] struct {
+	// The items, with the gap in [gapStart, gapEnd).
+	content  []Content
+	gapStart int
+	gapEnd   int
+	// The undo/redo list.
+	edits []gapEdit[Content]
+	// The top of the undo/redo list, i.e., the current edit is undoTop-1.
+	undoTop int
+	// Decides wether edits are merged. Nil means DefaultCoalescing.
+	coalescePolicy CoalescePolicy[Content]
+	// Wether the last action was an insertion or deletion that the next one
+	// may be merged into.
+	coalescing bool
+	// The item inserted or deleted by the last action.
+	lastItem Content
+}
+
+// An insertion or deletion of the items at start.
+type gapEdit[Content any] struct {
+	kind  EditKind
+	start int
+	items []Content
+	time  time.Time // When it was made or extended.
+}
+
+func (e gapEdit[Content]) info() EditInfo {
+	info := EditInfo{Kind: e.kind, Start: e.start}
+	if e.kind == KindInsertion {
+		info.Inserted = len(e.items)
+	} else {
+		info.Removed = len(e.items)
+	}
+	return info
+}
+
+// NewGapBuffer returns an empty gap buffer.
+func NewGapBuffer[Content any]() *GapBuffer[Content] {
+	return new(GapBuffer[Content])
+}
+
+// GapBufferFromSlice returns a gap buffer initialized with the contents of the
+// slice.
+func GapBufferFromSlice[Content any](content []Content) *GapBuffer[Content] {
+	g := new(GapBuffer[Content])
+	g.content = make([]Content, len(content)+minGapSize)
+	copy(g.content, content)
+	g.gapStart = len(content)
+	g.gapEnd = len(g.content)
+	return g
+}
+
+// Get returns the item at the index idx.
+func (g *GapBuffer[Content]) Get(idx int) (Content, error) {
+	if idx < 0 || idx >= g.Size() {
+		var zero Content
+		return zero, ErrorOutOfBounds
+	}
+	return g.at(idx), nil
+}
+
+// Size returns the amount of items in the gap buffer.
+func (g *GapBuffer[Content]) Size() int {
+	return len(g.content) - (g.gapEnd - g.gapStart)
+}
+
+// Insert inserts a single item in the index idx. You can set idx to the size
+// of the gap buffer to append onto it.
+func (g *GapBuffer[Content]) Insert(idx int, item Content) error {
+	if idx < 0 || idx > g.Size() {
+		return ErrorOutOfBounds
+	}
+	g.insert(idx, item)
+
+	if g.coalesces(KindInsertion, idx, item) {
+		e := &g.edits[g.undoTop-1]
+		e.items = append(e.items, item)
+		e.time = time.Now()
+	} else {
+		g.push(gapEdit[Content]{
+			kind:  KindInsertion,
+			start: idx,
+			items: []Content{item},
+			time:  time.Now(),
+		})
+	}
+	g.lastItem = item
+	g.coalescing = true
+	return nil
+}
+
+// Delete removes the item on the index idx.
+func (g *GapBuffer[Content]) Delete(idx int) error {
+	if idx < 0 || idx >= g.Size() {
+		return ErrorOutOfBounds
+	}
+	item := g.delete(idx, 1)[0]
+
+	if g.coalesces(KindDeletion, idx, item) {
+		e := &g.edits[g.undoTop-1]
+		if idx == e.start {
+			e.items = append(e.items, item)
+		} else {
+			e.items = slices.Insert(e.items, 0, item)
+			e.start = idx
+		}
+		e.time = time.Now()
+	} else {
+		g.push(gapEdit[Content]{
+			kind:  KindDeletion,
+			start: idx,
+			items: []Content{item},
+			time:  time.Now(),
+		})
+	}
+	g.lastItem = item
+	g.coalescing = true
+	return nil
+}
+
+// Undo undoes the last edit. Returns the index where the cursor should be
+// placed.
+func (g *GapBuffer[Content]) Undo() (int, error) {
+	if g.undoTop < 1 {
+		return 0, ErrorBottomOfUndoList
+	}
+	g.undoTop--
+	e := g.edits[g.undoTop]
+	if e.kind == KindInsertion {
+		g.delete(e.start, len(e.items))
+	} else {
+		g.insert(e.start, e.items...)
+	}
+	g.coalescing = false
+	return e.info().inverse().End(), nil
+}
+
+// Redo redoes the last edit, if the last action was an undo. Returns the index
+// where the cursor should be placed.
+func (g *GapBuffer[Content]) Redo() (int, error) {
+	if g.undoTop == len(g.edits) {
+		return 0, ErrorTopOfUndoList
+	}
+	e := g.edits[g.undoTop]
+	g.undoTop++
+	if e.kind == KindInsertion {
+		g.insert(e.start, e.items...)
+	} else {
+		g.delete(e.start, len(e.items))
+	}
+	g.coalescing = false
+	return e.info().End(), nil
+}
+
+// SetCoalescePolicy sets the policy that decides wether insertions and
+// deletions are merged into the last edit. Nil restores DefaultCoalescing.
+func (g *GapBuffer[Content]) SetCoalescePolicy(p CoalescePolicy[Content]) {
+	g.coalescePolicy = p
+}
+
+// All iterates over the indexes and items of the gap buffer, in order. The gap
+// buffer must not be edited while iterating.
+func (g *GapBuffer[Content]) All() iter.Seq2[int, Content] {
+	return func(yield func(int, Content) bool) {
+		for i, c := range g.content[:g.gapStart] {
+			if !yield(i, c) {
+				return
+			}
+		}
+		for i, c := range g.content[g.gapEnd:] {
+			if !yield(g.gapStart+i, c) {
+				return
+			}
+		}
+	}
+}
+
+// Returns the item at idx, which must be in bounds.
+func (g *GapBuffer[Content]) at(idx int) Content {
+	if idx < g.gapStart {
+		return g.content[idx]
+	}
+	return g.content[idx+g.gapEnd-g.gapStart]
+}
+
+// Pushes a new edit, discarding the ones undone.
+func (g *GapBuffer[Content]) push(e gapEdit[Content]) {
+	g.edits = append(g.edits[:g.undoTop], e)
+	g.undoTop++
+}
+
+// Returns wether an insertion or deletion of item at idx, of the given kind,
+// should be merged into the last edit.
+func (g *GapBuffer[Content]) coalesces(
+	kind EditKind,
+	idx int,
+	item Content,
+) bool {
+	if !g.coalescing || g.undoTop == 0 {
+		return false
+	}
+
+	last := g.edits[g.undoTop-1]
+	return coalesces(
+		g.coalescePolicy,
+		kind,
+		last.info(),
+		last.time,
+		idx,
+		item,
+		g.lastItem,
+	)
+}
+
+// Moves the gap to begin at idx.
+func (g *GapBuffer[Content]) moveGap(idx int) {
+	switch {
+	case idx < g.gapStart:
+		n := g.gapStart - idx
+		copy(g.content[g.gapEnd-n:g.gapEnd], g.content[idx:g.gapStart])
+		// What was moved is in the gap now, so it must not be referenced.
+		clear(g.content[idx:min(g.gapStart, g.gapEnd-n)])
+		g.gapStart -= n
+		g.gapEnd -= n
+	case idx > g.gapStart:
+		n := idx - g.gapStart
+		copy(g.content[g.gapStart:], g.content[g.gapEnd:g.gapEnd+n])
+		clear(g.content[max(g.gapEnd, idx) : g.gapEnd+n])
+		g.gapStart += n
+		g.gapEnd += n
+	}
+}
+
+// Inserts the items at idx, growing the gap if needed.
+func (g *GapBuffer[Content]) insert(idx int, items ...Content) {
+	if g.gapEnd-g.gapStart < len(items) {
+		size := g.Size()
+		content := make(
+			[]Content,
+			max(2*len(g.content), size+len(items)+minGapSize),
+		)
+		copy(content, g.content[:g.gapStart])
+		after := len(g.content) - g.gapEnd
+		copy(content[len(content)-after:], g.content[g.gapEnd:])
+		g.gapEnd = len(content) - after
+		g.content = content
+	}
+
+	g.moveGap(idx)
+	copy(g.content[g.gapStart:], items)
+	g.gapStart += len(items)
+}
+
+// Deletes n items from idx, returning a copy of them.
+func (g *GapBuffer[Content]) delete(idx, n int) []Content {
+	g.moveGap(idx)
+	removed := slices.Clone(g.content[g.gapEnd : g.gapEnd+n])
+	clear(g.content[g.gapEnd : g.gapEnd+n])
+	g.gapEnd += n
+	return removed
+}
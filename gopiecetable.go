@@ -5,6 +5,7 @@ package gopiecetable
 import (
 	"errors"
 	"slices"
+	"time"
 )
 
 // Using slices for representing pieces was kinda weird so I didn't.
@@ -13,7 +14,8 @@ import (
 var ErrorOutOfBounds = errors.New("out of bounds")
 
 // PieceTable implements an efficient Piece Table with infinite undo/redo
-// capabilities. You should get one from New, FromString or FromSlice.
+// capabilities. You should get one from New, FromString or FromSlice, which
+// accept options to bound the undo/redo list.
 type PieceTable[Content any] struct {
 	// The first buffer never changes and does not respect the buffer size if
 	// the piece table is initialized with content.
@@ -26,6 +28,52 @@ type PieceTable[Content any] struct {
 	size int
 	// The top of the undo/redo list, i.e., the current edit is undoTop-1.
 	undoTop int
+	// Items of the edits discarded since the last compaction.
+	discarded int
+	// Items inserted and deleted by the edits in the undo/redo list.
+	editedItems int
+	// Edits dropped from the beggining of the undo/redo list since it was
+	// last copied, which still take room in its array.
+	droppedEdits int
+	// The last state set with SetCursorState.
+	cursorState any
+	// Wether the next state set is the one after the current edit.
+	awaitingCursor bool
+	// Decides wether edits are merged. Nil means DefaultCoalescing.
+	coalescePolicy CoalescePolicy[Content]
+	// Wether the last action was an insertion or deletion that the next one
+	// may be merged into.
+	coalescing bool
+	// The item inserted or deleted by the last action.
+	lastItem Content
+	// Wether the last insertion or deletion was merged into the last edit.
+	merged bool
+	// Wether the next insertion or deletion is merged into the last edit
+	// whatever the policy, e.g., the second rune of a CRLF.
+	mergeNext bool
+	// The last revision given to an edit.
+	lastRevision uint64
+	// The revision at the bottom of the undo/redo list.
+	baseRevision uint64
+	// The revision marked clean.
+	cleanRevision uint64
+	// How many times the buffers were compacted, so pieces from different
+	// epochs are not mixed.
+	epoch   int
+	options options
+	// The calls recorded, if recording.
+	calls []Call[Content]
+	// The edits discarded by WithMaxAge since the last call was recorded.
+	aged int
+	// The call being replayed, if replaying.
+	replaying *Call[Content]
+	// The first error writing to the journal, after which it's not written
+	// anymore.
+	journalErr error
+	// When the journal was last synced.
+	journalSynced time.Time
+	// The line breaks, for PieceTable[rune].
+	lines *lineIndex
 }
 
 // A piece.
@@ -36,16 +84,21 @@ type piece struct {
 }
 
 // New returns an empty piece table.
-func New[Content any]() *PieceTable[Content] {
+func New[Content any](opts ...Option) *PieceTable[Content] {
 	buffer := new(PieceTable[Content])
+	buffer.configure(opts)
 	buffer.buffers = make([]backingBuffer[Content], 1)
 	buffer.buffers[0] = newBackingBuffer[Content](buffer.bufferSize())
 	return buffer
 }
 
 // FromSlice returns a piece table initialized with the contents of the slice.
-func FromSlice[Content any](content []Content) *PieceTable[Content] {
+func FromSlice[Content any](
+	content []Content,
+	opts ...Option,
+) *PieceTable[Content] {
 	buffer := new(PieceTable[Content])
+	buffer.configure(opts)
 	buffer.buffers = make([]backingBuffer[Content], 2)
 
 	// Here the memory we alloc is exactly the needed.
@@ -57,11 +110,14 @@ func FromSlice[Content any](content []Content) *PieceTable[Content] {
 		buffer.buffers[0].append(c)
 		buffer.size++
 	}
-	buffer.pieces = append(buffer.pieces, piece{
-		buffer: 0,
-		start:  0,
-		length: buffer.buffers[0].size(),
-	})
+	// Empty pieces are never kept.
+	if buffer.size > 0 {
+		buffer.pieces = append(buffer.pieces, piece{
+			buffer: 0,
+			start:  0,
+			length: buffer.size,
+		})
+	}
 
 	return buffer
 }
@@ -70,9 +126,8 @@ func FromSlice[Content any](content []Content) *PieceTable[Content] {
 func Content[Content any](b *PieceTable[Content]) []Content {
 	content := make([]Content, 0, b.Size())
 
-	for _, piece := range b.pieces {
-		c := b.pieceContent(piece)
-		content = append(content, c...)
+	for s := range b.segments(0, b.size) {
+		content = append(content, s...)
 	}
 
 	return content
@@ -81,6 +136,20 @@ func Content[Content any](b *PieceTable[Content]) []Content {
 // Inserts inserts a single item r in the index idx at the piece table. You can
 // set idx to the size of the piece table to append onto it.
 func (b *PieceTable[Content]) Insert(idx int, r Content) error {
+	err := b.insert(idx, r)
+	b.record(Call[Content]{
+		Kind:   CallInsert,
+		Index:  idx,
+		Item:   r,
+		Merged: err == nil && b.merged,
+	}, err)
+	return err
+}
+
+func (b *PieceTable[Content]) insert(idx int, r Content) error {
+	if idx < 0 || idx > b.size {
+		return ErrorOutOfBounds
+	}
 	if len(b.pieces) == 0 {
 		b.insertFirst(r)
 		return nil
@@ -106,29 +175,24 @@ func (b *PieceTable[Content]) Insert(idx int, r Content) error {
 	b.appendToBack(r)
 
 	// If "appending" on the piece and the piece is pointing to the end of the
-	// buffers, we literally append onto it. There's no need for a new undo.
+	// buffers, we literally append onto it.
 	if disp == piec.length {
-		buf, i := b.indexByPiece(piec, piec.length-1)
-		// Minus 2 because we need to exclude the item we just inserted.
-		sm1 := b.buffers[buf].size() - 2
-		// We DO want a new undo entry in the case the last one was a
-		// deletion.
-		if b.lastIsInsertion() && buf == buffer && i == sm1 {
-			b.extendInsertion()
+		if b.contiguous(piec, newPiece) {
 			b.pieces[pidx].length++
+			b.undoRedoManageInsertion(idx, r, b.spanOf(pidx, 1, []piece{piec}))
 			return nil
 		}
 
 		// Else we insert the new piece.
 		b.pieces = slices.Insert(b.pieces, pidx+1, newPiece)
-		b.pushInsertion(idx, pidx+1, newPiece)
+		b.undoRedoManageInsertion(idx, r, b.spanOf(pidx+1, 1, nil))
 		return nil
 	}
 
 	// If inserting in the beggining of a piece.
 	if disp == 0 {
 		b.pieces = slices.Insert(b.pieces, pidx, newPiece)
-		b.pushInsertion(idx, pidx, newPiece)
+		b.undoRedoManageInsertion(idx, r, b.spanOf(pidx, 1, nil))
 		return nil
 	}
 
@@ -136,10 +200,12 @@ func (b *PieceTable[Content]) Insert(idx int, r Content) error {
 
 	orig := b.pieces[pidx]
 
-	// We make the existing piece the right one.
+	// We make the existing piece the right one. It may begin in another buffer
+	// if the piece spans more than one.
+	rbuf, rdisp := b.indexByPiece(orig, disp)
 	b.pieces[pidx] = piece{
-		buffer: orig.buffer,
-		start:  orig.start + disp,
+		buffer: rbuf,
+		start:  rdisp,
 		length: orig.length - disp,
 	}
 
@@ -153,7 +219,7 @@ func (b *PieceTable[Content]) Insert(idx int, r Content) error {
 		length: disp,
 	})
 
-	b.pushInsertion(idx, pidx+1, newPiece)
+	b.undoRedoManageInsertion(idx, r, b.spanOf(pidx, 3, []piece{orig}))
 
 	return nil
 }
@@ -170,11 +236,21 @@ func (b *PieceTable[Content]) insertFirst(r Content) {
 	}
 	b.appendToBack(r)
 	b.pieces = append(b.pieces, newPiece)
-	b.pushInsertion(0, 0, newPiece)
+	b.undoRedoManageInsertion(0, r, b.spanOf(0, 1, nil))
 }
 
 // Delete removes the item on the index idx.
 func (b *PieceTable[Content]) Delete(idx int) error {
+	err := b.delete(idx)
+	b.record(Call[Content]{
+		Kind:   CallDelete,
+		Index:  idx,
+		Merged: err == nil && b.merged,
+	}, err)
+	return err
+}
+
+func (b *PieceTable[Content]) delete(idx int) error {
 	pidx, disp, err := b.findPieceWithIdx(idx)
 	if err != nil {
 		return err
@@ -184,28 +260,20 @@ func (b *PieceTable[Content]) Delete(idx int) error {
 	b.size--
 
 	piec := b.pieces[pidx]
+	npieces := len(b.pieces)
 	buf, bd := b.indexByPiece(piec, disp)
+	r := b.buffers[buf].content[bd]
 
 	switch disp {
 	// If removing from the top of the piece, we can simply decrease.
 	case piec.length - 1:
 		b.pieces[pidx].length--
-		i := pidx + 1
-		if b.pieces[pidx].length == 0 {
-			i--
-		}
-		b.undoRedoManageDeletion(idx, i, piece{
-			buffer: buf, start: bd, length: 1,
-		})
 
 	// If removing from the beggining of the piece, we can simply increase the
 	// start.
 	case 0:
 		b.pieces[pidx].start++
 		b.pieces[pidx].length--
-		b.undoRedoManageDeletion(idx, pidx, piece{
-			buffer: buf, start: bd, length: 1,
-		})
 
 		// If the piece begins at the end of the buffer.
 		if b.pieces[pidx].start == b.buffers[b.pieces[pidx].buffer].size() {
@@ -222,21 +290,30 @@ func (b *PieceTable[Content]) Delete(idx int) error {
 		}
 		b.pieces[pidx].length = disp
 		b.pieces = slices.Insert(b.pieces, pidx+1, newPiece)
-		b.undoRedoManageDeletion(idx, pidx+1, piece{
-			buffer: buf, start: bd, length: 1,
-		})
 	}
 
+	before := []piece{piec}
+
 	// If the length of the piece now is 0, we can remove it.
 	if b.pieces[pidx].length == 0 {
 		b.pieces = slices.Delete(b.pieces, pidx, pidx+1)
-		// When removing, we may have sequential pieces. We can merge then.
-		// TODO: IMPLEMENT PIECE MERGING THAT WORKS WITH UNDO/REDO.
-		// if pidx > 0 {
-		// 	b.pieces = b.tryMergePieces(pidx-1, pidx, b.pieces)
-		// }
+		// When removing, we may have sequential pieces. We can merge then,
+		// as long as the edit remembers both of them.
+		if pidx > 0 &&
+			pidx < len(b.pieces) &&
+			b.contiguous(b.pieces[pidx-1], b.pieces[pidx]) {
+			pidx--
+			before = []piece{b.pieces[pidx], piec, b.pieces[pidx+1]}
+			b.pieces = b.mergePieces(pidx, pidx+1, b.pieces)
+		}
 	}
 
+	b.undoRedoManageDeletion(
+		idx,
+		r,
+		b.spanOf(pidx, len(before)+len(b.pieces)-npieces, before),
+	)
+
 	return nil
 }
 
@@ -257,23 +334,17 @@ func (b *PieceTable[Content]) Size() int {
 	return b.size
 }
 
-// Given two indexes and a slice of pieces, tries to merge the given pieces.
-// p2i must be p1i+1.
-func (b *PieceTable[Content]) tryMergePieces(p1i, p2i int, pieces []piece) []piece {
-	p1 := pieces[p1i]
-	p2 := pieces[p2i]
+// Returns wether p2 begins right after p1 ends in the buffers, i.e., wether
+// they can be merged.
+func (b *PieceTable[Content]) contiguous(p1, p2 piece) bool {
 	p1endbuf, p1enddisp := b.indexByPiece(p1, p1.length-1)
 
 	// If the p1end is at the end of a buffer, we have to check wether the p2
 	// begin is at the begin of the next one.
 	if p1enddisp == b.buffers[p1endbuf].size()-1 {
-		if p2.start == 0 && p2.buffer == p1endbuf+1 {
-			return b.mergePieces(p1i, p2i, pieces)
-		}
-	} else if p1endbuf == p2.buffer && p1enddisp == p2.start-1 {
-		return b.mergePieces(p1i, p2i, pieces)
+		return p2.start == 0 && p2.buffer == p1endbuf+1
 	}
-	return pieces
+	return p1endbuf == p2.buffer && p1enddisp == p2.start-1
 }
 
 // Merges two sequential pieces.
@@ -286,6 +357,9 @@ func (b *PieceTable[Content]) mergePieces(p1i, p2i int, pieces []piece) []piece
 
 // Finds the piece with a given index.
 func (b *PieceTable[Content]) findPieceWithIdx(idx int) (i int, d int, err error) {
+	if idx < 0 {
+		return 0, 0, ErrorOutOfBounds
+	}
 	disp := 0
 	for i, piece := range b.pieces {
 		ndisp := piece.length + disp
@@ -304,6 +378,9 @@ func (b *PieceTable[Content]) findPieceWithIdx(idx int) (i int, d int, err error
 func (b *PieceTable[Content]) findPieceForInsertion(
 	idx int,
 ) (i int, d int, err error) {
+	if idx < 0 {
+		return 0, 0, ErrorOutOfBounds
+	}
 	disp := 0
 	for i, piece := range b.pieces {
 		ndisp := piece.length + disp
@@ -316,22 +393,6 @@ func (b *PieceTable[Content]) findPieceForInsertion(
 	return 0, 0, ErrorOutOfBounds
 }
 
-// Returns the content of a piece.
-func (b *PieceTable[Content]) pieceContent(p piece) []Content {
-	arr := make([]Content, 0, p.length)
-	buf := p.buffer
-	bdisp := p.start
-	for range p.length {
-		if bdisp >= b.buffers[buf].size() {
-			bdisp = 0
-			buf++
-		}
-		arr = append(arr, b.buffers[buf].content[bdisp])
-		bdisp++
-	}
-	return arr
-}
-
 // Returns the buffer and displacement with a given displacement inside a given
 // piece.
 func (b *PieceTable[Content]) indexByPiece(p piece, d int) (buffer int, bdisp int) {
@@ -345,7 +406,7 @@ func (b *PieceTable[Content]) indexByPiece(p piece, d int) (buffer int, bdisp in
 	for {
 		newdisp := disp + b.buffers[buf].size()
 		if newdisp > d {
-			return buf, newdisp - d
+			return buf, d - disp
 		}
 		buf++
 		disp = newdisp
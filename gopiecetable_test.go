@@ -2,9 +2,14 @@ package gopiecetable
 
 import (
 	_ "embed"
+	"errors"
+	"fmt"
 	"math/rand/v2"
+	"os"
 	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 //go:embed os-lusíadas.txt
@@ -240,13 +245,35 @@ func TestReadme(t *testing.T) {
 	helperTestContent(t, b, "Hello, World!")
 }
 
+// Saves the calls recorded by the piece table if the test fails, so the
+// failure can be reproduced with Replay.
+func helperSaveLog[Content any](t *testing.T, b *PieceTable[Content]) {
+	t.Cleanup(func() {
+		if !t.Failed() {
+			return
+		}
+		f, err := os.CreateTemp("", "gopiecetable-*.jsonl")
+		if err != nil {
+			t.Logf("can't save the calls: %v", err)
+			return
+		}
+		defer f.Close()
+		if err := WriteLog(f, b.Recorded()); err != nil {
+			t.Logf("can't save the calls: %v", err)
+			return
+		}
+		t.Logf("calls saved to %v", f.Name())
+	})
+}
+
 func TestRandomEdits(t *testing.T) {
 	reference := make([]rune, 0, len(bigString))
 	for _, c := range bigString {
 		reference = append(reference, c)
 	}
 
-	b := FromString(bigString)
+	b := FromString(bigString, WithRecording())
+	helperSaveLog(t, b)
 
 	// Use a custom rng with set seeds for determinism.
 	rng := rand.New(rand.NewPCG(420, 69))
@@ -277,6 +304,7 @@ func TestRandomEdits(t *testing.T) {
 			reference = slices.Insert(reference, int(position), randomRune)
 			b.Insert(int(position), randomRune)
 		}
+		helperTestValid(t, b)
 
 		for i, r := range reference {
 			c, err := b.Get(i)
@@ -301,3 +329,2264 @@ func TestRandomEdits(t *testing.T) {
 		}
 	}
 }
+
+func helperTestValid[Content any](t *testing.T, b *PieceTable[Content]) {
+	if err := b.validate(); err != nil {
+		t.Fatalf("invalid piece table: %v", err)
+	}
+}
+
+func TestRedoDeletion(t *testing.T) {
+	b := FromString("Hello, World")
+	b.Delete(5) // "Hello World"
+	b.Undo()    // "Hello, World"
+	b.Redo()    // "Hello World"
+
+	helperTestContent(t, b, "Hello World")
+	if b.Size() != len("Hello World") {
+		t.Fatalf("size doesn't match: %v (expected %v)", b.Size(), 11)
+	}
+	helperTestValid(t, b)
+}
+
+func TestUndoDeletionAfterInsertion(t *testing.T) {
+	b := FromString("XYZ")
+	helperInsertBeggining(b, "ab") // "abXYZ"
+	b.Delete(1)                    // "aXYZ"
+	b.Undo()                       // "abXYZ"
+	helperTestContent(t, b, "abXYZ")
+	b.Undo() // "XYZ"
+	helperTestContent(t, b, "XYZ")
+	helperTestValid(t, b)
+	b.Redo() // "abXYZ"
+	b.Redo() // "aXYZ"
+	helperTestContent(t, b, "aXYZ")
+	helperTestValid(t, b)
+}
+
+func TestMergePieces(t *testing.T) {
+	b := FromString("hello")
+	helperInsertMiddle(b, "123", 2) // "he123llo"
+	for i := 4; i >= 2; i-- {
+		b.Delete(i)
+	}
+
+	helperTestContent(t, b, "hello")
+	helperTestValid(t, b)
+	if len(b.pieces) != 1 {
+		t.Fatalf("pieces were not merged: %v", b.pieces)
+	}
+
+	b.Undo() // "he123llo"
+	helperTestContent(t, b, "he123llo")
+	helperTestValid(t, b)
+	b.Redo() // "hello"
+	helperTestContent(t, b, "hello")
+	helperTestValid(t, b)
+}
+
+func TestRandomUndoRedo(t *testing.T) {
+	reference := []rune(testString)
+	// Small buffers so pieces cross them.
+	b := FromString(testString, WithBufferSize(16))
+
+	// The content at each position of the undo list, so states[b.undoTop] is
+	// what the piece table must have.
+	states := [][]rune{slices.Clone(reference)}
+
+	rng := rand.New(rand.NewPCG(1337, 42))
+	position := rng.IntN(len(reference))
+
+	for range 5000 {
+		switch op := rng.IntN(100); {
+		case op < 15:
+			_, err := b.Undo()
+			if err != nil && b.undoTop != 0 {
+				t.Fatalf("undo failed: %v", err)
+			}
+			reference = slices.Clone(states[b.undoTop])
+		case op < 25:
+			_, err := b.Redo()
+			if err != nil && b.undoTop != len(b.edits) {
+				t.Fatalf("redo failed: %v", err)
+			}
+			reference = slices.Clone(states[b.undoTop])
+		case op < 27:
+			b.Compact()
+		default:
+			// Mostly type or backspace sequentially so edits coalesce.
+			if rng.IntN(10) < 2 {
+				position = rng.IntN(len(reference) + 1)
+			}
+			top := b.undoTop
+			if op < 60 && len(reference) > 0 {
+				position = min(max(position-1, 0), len(reference)-1)
+				reference = slices.Delete(reference, position, position+1)
+				if err := b.Delete(position); err != nil {
+					t.Fatalf("delete failed: %v", err)
+				}
+			} else {
+				position = min(position, len(reference))
+				r := rune('a' + rng.IntN(26))
+				reference = slices.Insert(reference, position, r)
+				if err := b.Insert(position, r); err != nil {
+					t.Fatalf("insert failed: %v", err)
+				}
+				position++
+			}
+			// The edit may have coalesced into the last one.
+			states = states[:top+1]
+			if b.undoTop > top {
+				states = append(states, nil)
+			}
+			states[b.undoTop] = slices.Clone(reference)
+		}
+
+		helperTestValid(t, b)
+		helperTestContent(t, b, string(reference))
+		if len(reference) != b.Size() {
+			t.Fatalf(
+				"size doesn't match: %v (expected %v)",
+				b.Size(),
+				len(reference),
+			)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	b := FromString(testString)
+	helperInsertEnd(b, bigString[:4000])
+	helperInsertMiddle(b, "빠져버리는", 11)
+	for i := b.Size() - 1; i >= len([]rune(testString))+5; i-- {
+		b.Delete(i)
+	}
+	b.Delete(0)
+	expected := String(b)
+
+	// Only the deletion of the first item is kept.
+	b.TrimHistory(1)
+	if len(b.edits) != 1 {
+		t.Fatalf("history was not trimmed: %v edits", len(b.edits))
+	}
+
+	reclaimed := b.Compact()
+	if reclaimed <= 0 {
+		t.Fatalf("nothing was reclaimed: %v", reclaimed)
+	}
+	helperTestContent(t, b, expected)
+	helperTestValid(t, b)
+
+	// Undoing must still work after compacting.
+	b.Undo()
+	helperTestContent(t, b, "H"+expected)
+	if _, err := b.Undo(); err != ErrorBottomOfUndoList {
+		t.Fatalf("expected bottom of undo list, got %v", err)
+	}
+	helperTestValid(t, b)
+	b.Redo()
+	helperTestContent(t, b, expected)
+	helperTestValid(t, b)
+
+	// And editing.
+	helperInsertEnd(b, "daydream")
+	helperTestContent(t, b, expected+"daydream")
+	helperTestValid(t, b)
+}
+
+func TestCompactKeepsHistory(t *testing.T) {
+	b := FromString(testString)
+	states := []string{String(b)}
+	helperInsertMiddle(b, "Hype boy", 5)
+	states = append(states, String(b))
+	b.Delete(20)
+	b.Delete(19)
+	states = append(states, String(b))
+	helperInsertBeggining(b, "빠져버리는")
+	states = append(states, String(b))
+	b.Undo()
+
+	b.Compact()
+	helperTestValid(t, b)
+	helperTestContent(t, b, states[2])
+	b.Redo()
+	helperTestContent(t, b, states[3])
+	for i := len(states) - 2; i >= 0; i-- {
+		b.Undo()
+		helperTestValid(t, b)
+		helperTestContent(t, b, states[i])
+	}
+}
+
+func TestMaxEdits(t *testing.T) {
+	b := FromString("hello", WithMaxEdits(2))
+	b.Insert(0, 'a')
+	b.Delete(3)
+	b.Insert(3, 'b')
+	if len(b.edits) != 2 {
+		t.Fatalf("expected 2 edits, got %v", len(b.edits))
+	}
+	b.Undo()
+	b.Undo()
+	helperTestContent(t, b, "ahello")
+	if _, err := b.Undo(); err != ErrorBottomOfUndoList {
+		t.Fatalf("expected bottom of undo list, got %v", err)
+	}
+	helperTestValid(t, b)
+}
+
+func TestMaxEditedItems(t *testing.T) {
+	b := FromString("hello", WithMaxEditedItems(5))
+	helperInsertEnd(b, "abc")      // One edit of 3 items.
+	b.Delete(0)                    // One edit of 1 item.
+	helperInsertBeggining(b, "de") // One edit of 2 items.
+	if len(b.edits) != 2 {
+		t.Fatalf("expected 2 edits, got %v", len(b.edits))
+	}
+	helperTestValid(t, b)
+}
+
+func TestLongHistory(t *testing.T) {
+	b := New[rune](WithMaxEdits(100), WithMaxEditedItems(150))
+	b.SetCoalescePolicy(NoCoalescing[rune]())
+	for i := range 10000 {
+		b.Insert(i, 'a')
+	}
+	helperTestValid(t, b)
+	if len(b.edits) != 100 {
+		t.Fatalf("expected 100 edits, got %v", len(b.edits))
+	}
+	// The edits dropped from the beggining are not kept around.
+	if cap(b.edits) > 300 {
+		t.Fatalf("the list of 100 edits has capacity %v", cap(b.edits))
+	}
+
+	// Edits of 3 items each, so 50 fit.
+	b.SetCoalescePolicy(nil)
+	for range 100 {
+		b.Insert(0, 'b')
+		b.Insert(1, 'b')
+		b.Insert(2, 'b')
+	}
+	helperTestValid(t, b)
+	if n := helperCountUndos(b); n != 50 {
+		t.Fatalf("expected 50 edits, got %v", n)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	b := FromString("hello", WithMaxAge(time.Minute))
+	b.Insert(0, 'a')
+	b.Delete(3)
+
+	// Pretend the first edit is old.
+	i := b.edits[0].(insertion)
+	i.time = i.time.Add(-time.Hour)
+	b.edits[0] = i
+
+	b.Insert(3, 'b')
+	if len(b.edits) != 2 {
+		t.Fatalf("expected 2 edits, got %v", len(b.edits))
+	}
+	helperTestValid(t, b)
+}
+
+func TestAutoCompact(t *testing.T) {
+	b := FromString("hello", WithMaxEdits(1), WithAutoCompact(100))
+	helperInsertEnd(b, bigString[:200])
+	// Backspace everything we inserted.
+	for i := b.Size() - 1; i >= 5; i-- {
+		b.Delete(i)
+	}
+	b.Insert(0, 'a') // Discards the insertion and deletion.
+	if b.discarded != 0 {
+		t.Fatalf("buffers were not compacted")
+	}
+	// "hello", a hole and 'a'.
+	if b.buffers[0].size() != 7 {
+		t.Fatalf("compacted buffer has %v items", b.buffers[0].size())
+	}
+	helperTestContent(t, b, "ahello")
+	helperTestValid(t, b)
+}
+
+func TestBufferSize(t *testing.T) {
+	b := New[rune](WithBufferSize(32))
+	helperInsertEnd(b, testString)
+	if b.bufferSize() != 32 || cap(b.buffers[0].content) != 32 {
+		t.Fatalf("buffers don't hold 32 items")
+	}
+	helperTestContent(t, b, testString)
+	helperTestValid(t, b)
+
+	b = New[rune](WithBufferBytes(256))
+	if b.bufferSize() != 64 {
+		t.Fatalf("expected buffers of 64 items, got %v", b.bufferSize())
+	}
+
+	// The minimum.
+	b = New[rune](WithBufferSize(1))
+	if b.bufferSize() != minBufferSize {
+		t.Fatalf("expected buffers of 16 items, got %v", b.bufferSize())
+	}
+}
+
+func TestZeroSizedContent(t *testing.T) {
+	b := New[struct{}]()
+	for i := range 100 {
+		b.Insert(i, struct{}{})
+	}
+	b.Delete(50)
+	b.Undo()
+	b.Redo()
+	if b.Size() != 99 {
+		t.Fatalf("expected size 99, got %v", b.Size())
+	}
+	helperTestValid(t, b)
+}
+
+func TestLargeContent(t *testing.T) {
+	type large [1024]int
+	b := FromSlice([]large{{1}, {2}, {3}})
+	if b.bufferSize() != minBufferSize {
+		t.Fatalf("expected buffers of 16 items, got %v", b.bufferSize())
+	}
+
+	for i := range 100 {
+		b.Insert(b.Size(), large{i + 4})
+	}
+	for i := range b.Size() {
+		c, err := b.Get(i)
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		if c[0] != i+1 {
+			t.Fatalf("expected %v at %v, got %v", i+1, i, c[0])
+		}
+	}
+	helperTestValid(t, b)
+}
+
+func TestEditInfo(t *testing.T) {
+	b := FromString("Hello World")
+	helperInsertMiddle(b, ", my", 5) // "Hello, my World"
+	for i := 12; i >= 9; i-- {
+		b.Delete(i) // "Hello, myrld"
+	}
+
+	expected := []EditInfo{
+		{Kind: KindDeletion, Start: 9, Inserted: 4},
+		{Kind: KindInsertion, Start: 5, Removed: 4},
+	}
+	for _, e := range expected {
+		info, err := b.UndoEdit()
+		if err != nil {
+			t.Fatalf("undo failed: %v", err)
+		}
+		if info != e {
+			t.Fatalf("expected %+v, got %+v", e, info)
+		}
+	}
+
+	for i := len(expected) - 1; i >= 0; i-- {
+		info, err := b.RedoEdit()
+		if err != nil {
+			t.Fatalf("redo failed: %v", err)
+		}
+		if info != expected[i].inverse() {
+			t.Fatalf("expected %+v, got %+v", expected[i].inverse(), info)
+		}
+	}
+
+	// The old signatures return where the cursor goes.
+	if i, _ := b.Undo(); i != 13 {
+		t.Fatalf("expected cursor at 13, got %v", i)
+	}
+	if i, _ := b.Redo(); i != 9 {
+		t.Fatalf("expected cursor at 9, got %v", i)
+	}
+}
+
+func TestCursorState(t *testing.T) {
+	type cursor struct{ dot, mark int }
+
+	b := FromString("Hello World")
+	b.SetCursorState(cursor{5, 5})
+	helperInsertMiddle(b, ", my", 5) // "Hello, my World"
+	b.SetCursorState(cursor{9, 9})
+	b.SetCursorState(cursor{0, 5}) // Selecting "Hello".
+	for i := 4; i >= 0; i-- {
+		b.Delete(i) // ", my World"
+	}
+	b.SetCursorState(cursor{0, 0})
+
+	expected := []cursor{{0, 5}, {5, 5}}
+	for _, c := range expected {
+		info, _ := b.UndoEdit()
+		if info.CursorState != c {
+			t.Fatalf("expected %v, got %v", c, info.CursorState)
+		}
+	}
+
+	expected = []cursor{{9, 9}, {0, 0}}
+	for _, c := range expected {
+		info, _ := b.RedoEdit()
+		if info.CursorState != c {
+			t.Fatalf("expected %v, got %v", c, info.CursorState)
+		}
+	}
+}
+
+func helperCountUndos[Content any](b *PieceTable[Content]) int {
+	n := 0
+	for {
+		if _, err := b.Undo(); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestCoalescePolicies(t *testing.T) {
+	b := FromString("")
+	helperInsertEnd(b, "hello world")
+	b.Delete(1)
+	b.Delete(1)
+	if n := helperCountUndos(b); n != 3 {
+		t.Fatalf("default policy: expected 3 undos, got %v", n)
+	}
+
+	b = FromString("")
+	b.SetCoalescePolicy(NoCoalescing[rune]())
+	helperInsertEnd(b, "hello")
+	if n := helperCountUndos(b); n != 5 {
+		t.Fatalf("no coalescing: expected 5 undos, got %v", n)
+	}
+
+	b = FromString("hello world")
+	b.SetCoalescePolicy(ForwardDeletes(DefaultCoalescing[rune]()))
+	for range 3 {
+		b.Delete(2)
+	}
+	helperTestContent(t, b, "he world")
+	if n := helperCountUndos(b); n != 1 {
+		t.Fatalf("forward deletes: expected 1 undo, got %v", n)
+	}
+
+	b = FromString("")
+	b.SetCoalescePolicy(WordBoundaries(DefaultCoalescing[rune]()))
+	helperInsertEnd(b, "hello big  world")
+	for i := b.Size() - 1; i >= 6; i-- {
+		b.Delete(i) // "hello "
+	}
+	// "hello", " big", "  world", deleting "world", deleting "big  ".
+	if n := helperCountUndos(b); n != 5 {
+		t.Fatalf("word boundaries: expected 5 undos, got %v", n)
+	}
+	helperTestContent(t, b, "")
+
+	b = FromString("")
+	b.SetCoalescePolicy(TimeWindow(time.Minute, DefaultCoalescing[rune]()))
+	helperInsertEnd(b, "hel")
+	// Pretend the user paused.
+	i := b.edits[0].(insertion)
+	i.time = i.time.Add(-time.Hour)
+	b.edits[0] = i
+	helperInsertEnd(b, "lo")
+	if n := helperCountUndos(b); n != 2 {
+		t.Fatalf("time window: expected 2 undos, got %v", n)
+	}
+}
+
+func helperTestDirty[Content any](
+	t *testing.T,
+	b *PieceTable[Content],
+	expected bool,
+) {
+	t.Helper()
+	if b.IsDirty() != expected {
+		t.Fatalf("expected dirty to be %v", expected)
+	}
+}
+
+func TestDirty(t *testing.T) {
+	b := FromString("Hello World")
+	helperTestDirty(t, b, false)
+
+	helperInsertMiddle(b, ",", 5) // "Hello, World"
+	helperTestDirty(t, b, true)
+	b.MarkClean()
+	helperTestDirty(t, b, false)
+
+	b.Delete(6) // "Hello,World"
+	helperTestDirty(t, b, true)
+	b.Undo()
+	helperTestDirty(t, b, false)
+	b.Redo()
+	helperTestDirty(t, b, true)
+	b.Undo()
+	b.Undo()
+	helperTestDirty(t, b, true)
+	b.Redo()
+	helperTestDirty(t, b, false)
+
+	// Extending the marked edit.
+	b = FromString("Hello World")
+	b.Insert(5, ',') // "Hello, World"
+	b.MarkClean()
+	b.Insert(6, '!') // "Hello,! World"
+	helperTestDirty(t, b, true)
+	b.Undo()
+	helperTestDirty(t, b, true)
+	b.Redo()
+	helperTestDirty(t, b, true)
+
+	// Discarding the redo branch with the clean state.
+	b.MarkClean()
+	b.Undo()
+	b.Insert(0, '>')
+	b.Undo()
+	helperTestDirty(t, b, true)
+	b.Redo()
+	helperTestDirty(t, b, true)
+
+	// Dropping the edits below the clean state keeps it.
+	b = FromString("Hello", WithMaxEdits(1))
+	b.Insert(0, '>')
+	b.MarkClean()
+	b.Delete(1)
+	helperTestDirty(t, b, true)
+	b.Undo()
+	helperTestDirty(t, b, false)
+	b.Redo()
+	b.Insert(0, ' ') // Drops the edit that led to the clean state.
+	b.Undo()
+	b.Undo()
+	helperTestDirty(t, b, true)
+}
+
+func TestGoTo(t *testing.T) {
+	b := FromString("Hello World")
+	revisions := []uint64{b.Revision()}
+	states := []string{String(b)}
+
+	helperInsertMiddle(b, ",", 5) // "Hello, World"
+	revisions = append(revisions, b.Revision())
+	states = append(states, String(b))
+	b.Delete(0) // "ello, World"
+	revisions = append(revisions, b.Revision())
+	states = append(states, String(b))
+	helperInsertEnd(b, "!!") // "ello, World!!"
+	revisions = append(revisions, b.Revision())
+	states = append(states, String(b))
+
+	for i := 1; i < len(revisions); i++ {
+		if revisions[i] <= revisions[i-1] {
+			t.Fatalf("revisions don't increase: %v", revisions)
+		}
+	}
+
+	for _, i := range []int{0, 3, 1, 2, 2, 0} {
+		if err := b.GoTo(revisions[i]); err != nil {
+			t.Fatalf("goto failed: %v", err)
+		}
+		helperTestContent(t, b, states[i])
+		if b.Revision() != revisions[i] {
+			t.Fatalf("expected revision %v, got %v", revisions[i], b.Revision())
+		}
+	}
+
+	// Revisions in the redo branch are gone after editing.
+	b.Insert(0, 'H')
+	if err := b.GoTo(revisions[1]); err != ErrorNoSuchRevision {
+		t.Fatalf("expected no such revision, got %v", err)
+	}
+	helperTestContent(t, b, "H"+states[0])
+}
+
+func helperApplyHunks[Content any](a, b []Content, hunks []Hunk) []Content {
+	result := slices.Clone(a)
+	// Backwards so the indexes stay valid.
+	for i := len(hunks) - 1; i >= 0; i-- {
+		h := hunks[i]
+		result = slices.Replace(
+			result,
+			h.AStart,
+			h.AStart+h.ALength,
+			b[h.BStart:h.BStart+h.BLength]...,
+		)
+	}
+	return result
+}
+
+func TestDiff(t *testing.T) {
+	b := FromString(bigString[:10000])
+	a := b.Snapshot()
+	helperInsertMiddle(b, "빠져버리는", 3000)
+	for i := 7000; i >= 6990; i-- {
+		b.Delete(i)
+	}
+	c := b.Snapshot()
+
+	prefix, suffix := sharedAffixes(a, c)
+	if prefix != 3000 || suffix != a.Size()-6996 {
+		t.Fatalf("unexpected shared affixes: %v and %v", prefix, suffix)
+	}
+
+	hunks := Diff(a, c)
+	result := helperApplyHunks(a.Content(), c.Content(), hunks)
+	if string(result) != String(b) {
+		t.Fatalf("applying the hunks doesn't yield the new content")
+	}
+
+	// Snapshots of different tables are diffed by content only.
+	d := FromString(String(b)).Snapshot()
+	if hunks := Diff(c, d); len(hunks) != 0 {
+		t.Fatalf("expected no hunks, got %v", hunks)
+	}
+}
+
+func TestDiffBufferGrowth(t *testing.T) {
+	b := FromString("hello world", WithBufferSize(16))
+	b.Insert(5, '1')
+	a := b.Snapshot()
+	// New buffers are allocated after the snapshot is taken.
+	long := strings.Repeat("abcdefgh", 10)
+	helperInsertBeggining(b, long)
+	helperInsertEnd(b, long)
+	c := b.Snapshot()
+
+	for _, s := range [][2]Snapshot[rune]{{a, c}, {c, a}} {
+		hunks := Diff(s[0], s[1])
+		result := helperApplyHunks(s[0].Content(), s[1].Content(), hunks)
+		if string(result) != string(s[1].Content()) {
+			t.Fatalf("applying the hunks doesn't yield the new content")
+		}
+	}
+	expected := "--- a\n+++ b\n@@ -1 +1 @@\n" +
+		"-hello1 world\n\\ No newline at end of file\n" +
+		"+" + long + "hello1 world" + long + "\n" +
+		"\\ No newline at end of file\n"
+	if diff := UnifiedDiff(a, c, "a", "b", 3); diff != expected {
+		t.Fatalf("unexpected diff:\n%v", diff)
+	}
+}
+
+func TestDiffScattered(t *testing.T) {
+	b := FromString(bigString)
+	a := b.Snapshot()
+	rng := rand.New(rand.NewPCG(13, 21))
+	for range 5000 {
+		b.Insert(rng.IntN(b.Size()+1), '*')
+	}
+	c := b.Snapshot()
+
+	// Every unchanged run shares its pieces, so only the insertions are
+	// diffed.
+	hunks := Diff(a, c)
+	inserted := 0
+	for _, h := range hunks {
+		if h.ALength != 0 {
+			t.Fatalf("unexpected hunk %+v", h)
+		}
+		inserted += h.BLength
+	}
+	if inserted != 5000 {
+		t.Fatalf("hunks insert %v items, expected 5000", inserted)
+	}
+	result := helperApplyHunks(a.Content(), c.Content(), hunks)
+	if string(result) != String(b) {
+		t.Fatalf("applying the hunks doesn't yield the new content")
+	}
+
+	// Both ways.
+	hunks = Diff(c, a)
+	result = helperApplyHunks(c.Content(), a.Content(), hunks)
+	if string(result) != bigString || len(hunks) > 5000 {
+		t.Fatalf("applying %v hunks doesn't yield the old content", len(hunks))
+	}
+}
+
+func TestDiffRevisions(t *testing.T) {
+	b := FromString("Hello World")
+	rev := b.Revision()
+	helperInsertMiddle(b, ",", 5) // "Hello, World"
+	b.Delete(0)                   // "ello, World"
+	helperInsertEnd(b, "!!")      // "ello, World!!"
+
+	a, err := b.SnapshotAt(rev)
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if string(a.Content()) != "Hello World" {
+		t.Fatalf("unexpected snapshot content: %v", string(a.Content()))
+	}
+	helperTestContent(t, b, "ello, World!!")
+
+	expected := []Hunk{
+		{AStart: 0, ALength: 1, BStart: 0, BLength: 0},
+		{AStart: 5, ALength: 0, BStart: 4, BLength: 1},
+		{AStart: 11, ALength: 0, BStart: 11, BLength: 2},
+	}
+	if hunks := Diff(a, b.Snapshot()); !slices.Equal(hunks, expected) {
+		t.Fatalf("expected %v, got %v", expected, hunks)
+	}
+}
+
+func TestRandomDiff(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 11))
+	for range 200 {
+		b := FromString(testString)
+		for range rng.IntN(40) {
+			if rng.IntN(2) == 0 && b.Size() > 0 {
+				b.Delete(rng.IntN(b.Size()))
+			} else {
+				b.Insert(rng.IntN(b.Size()+1), rune('a'+rng.IntN(3)))
+			}
+		}
+
+		a, _ := b.SnapshotAt(0)
+		c := b.Snapshot()
+		result := helperApplyHunks(a.Content(), c.Content(), Diff(a, c))
+		if string(result) != String(b) {
+			t.Fatalf("applying the hunks doesn't yield the new content")
+		}
+	}
+}
+
+// Returns the least insertions and deletions that turn a into b.
+func helperDiffCost(a, b []rune) int {
+	// The longest common subsequence of the suffixes of a and b.
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	return len(a) + len(b) - 2*lcs[0][0]
+}
+
+func TestMinimalDiff(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 8))
+	for range 5000 {
+		a := make([]rune, rng.IntN(30))
+		b := make([]rune, rng.IntN(30))
+		letters := 1 + rng.IntN(4)
+		for i := range a {
+			a[i] = rune('a' + rng.IntN(letters))
+		}
+		for i := range b {
+			b[i] = rune('a' + rng.IntN(letters))
+		}
+
+		hunks := myers(a, b)
+		if string(helperApplyHunks(a, b, hunks)) != string(b) {
+			t.Fatalf("applying %v to %q doesn't yield %q", hunks, a, b)
+		}
+		cost := 0
+		for _, h := range hunks {
+			cost += h.ALength + h.BLength
+		}
+		if expected := helperDiffCost(a, b); cost != expected {
+			t.Fatalf("diff of %q and %q costs %v, not %v", a, b, cost, expected)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	b := FromString("one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine")
+	a := b.Snapshot()
+	b.Delete(4)                        // "one\nwo\n..."
+	b.Insert(4, 'T')                   // "one\nTwo\n..."
+	helperInsertMiddle(b, "4.5\n", 19) // After "four\n".
+	helperInsertEnd(b, "\n")           // "...nine\n"
+
+	expected := `--- a
++++ b
+@@ -1,5 +1,6 @@
+ one
+-two
++Two
+ three
+ four
++4.5
+ five
+@@ -8,2 +9,2 @@
+ eight
+-nine
+\ No newline at end of file
++nine
+`
+	if diff := UnifiedDiff(a, b.Snapshot(), "a", "b", 1); diff != expected {
+		t.Fatalf("unexpected diff:\n%v", diff)
+	}
+
+	if diff := UnifiedDiff(a, a, "a", "a", 3); diff != "" {
+		t.Fatalf("expected no diff, got:\n%v", diff)
+	}
+}
+
+func TestApplyTextEdits(t *testing.T) {
+	b := FromString("Hello World")
+	b.Insert(b.Size(), '!') // "Hello World!"
+	err := ApplyTextEdits(b, []TextEdit{
+		{Start: 6, End: 11, NewText: "there"},
+		{Start: 0, End: 1, NewText: "J"},
+		{Start: 5, End: 5, NewText: ","},
+		{Start: 5, End: 5, NewText: " oh"},
+	})
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	helperTestContent(t, b, "Jello, oh there!")
+	helperTestValid(t, b)
+
+	info, _ := b.UndoEdit()
+	expected := EditInfo{Kind: KindCompound, Start: 0, Removed: 15, Inserted: 11}
+	if info != expected {
+		t.Fatalf("expected %+v, got %+v", expected, info)
+	}
+	helperTestContent(t, b, "Hello World!")
+	helperTestValid(t, b)
+	b.Redo()
+	helperTestContent(t, b, "Jello, oh there!")
+	helperTestValid(t, b)
+	b.Undo()
+	b.Undo()
+	helperTestContent(t, b, "Hello World")
+
+	err = ApplyTextEdits(b, []TextEdit{
+		{Start: 0, End: 3, NewText: "a"},
+		{Start: 2, End: 4, NewText: "b"},
+	})
+	if !errors.Is(err, ErrorOverlappingEdits) {
+		t.Fatalf("expected overlapping edits, got %v", err)
+	}
+	err = ApplyTextEdits(b, []TextEdit{{Start: 0, End: 30}})
+	if !errors.Is(err, ErrorOutOfBounds) {
+		t.Fatalf("expected out of bounds, got %v", err)
+	}
+	helperTestContent(t, b, "Hello World")
+
+	// The new text is appended as a single piece, merged with the ones around
+	// it if contiguous.
+	big := FromString(bigString)
+	ApplyTextEdits(big, []TextEdit{{End: big.Size(), NewText: testString}})
+	helperTestContent(t, big, testString)
+	helperTestValid(t, big)
+	if len(big.pieces) != 1 {
+		t.Fatalf("expected a single piece, got %v", len(big.pieces))
+	}
+	big.Undo()
+	helperTestContent(t, big, bigString)
+
+	// Right after typing where the group begins, it's still its own edit.
+	b.Insert(b.Size(), '!')
+	ApplyTextEdits(b, []TextEdit{{Start: 12, End: 12, NewText: "?!"}})
+	helperTestValid(t, b)
+	b.Undo()
+	helperTestContent(t, b, "Hello World!")
+	b.Undo()
+	helperTestContent(t, b, "Hello World")
+}
+
+func TestApplyUnifiedDiff(t *testing.T) {
+	before := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine"
+	after := "one\nTwo\nthree\nfour\n4.5\nfive\nsix\nseven\neight\nnine\n"
+	a := FromString(before)
+	c := FromString(after)
+	patch := UnifiedDiff(a.Snapshot(), c.Snapshot(), "a", "b", 1)
+
+	b := FromString(before)
+	if err := ApplyUnifiedDiff(b, patch); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	helperTestContent(t, b, after)
+	helperTestValid(t, b)
+	b.Undo()
+	helperTestContent(t, b, before)
+
+	// Reapplying after undoing the first line.
+	if err := ApplyUnifiedDiff(c, patch); !errors.Is(err, ErrorConflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	helperTestContent(t, c, after)
+
+	for _, malformed := range []string{
+		"@@ -1 +1 @@\n?one\n",
+		// Truncated hunks.
+		"@@ -1,2 +1,2 @@\n-one\n+One\n",
+		"@@ -1,2 +1,2 @@\n-one\n+One\n@@ -5 +5 @@\n-five\n+Five\n",
+		// More lines than in the header.
+		"@@ -1 +1 @@\n-one\n-two\n+One\n",
+		"@@ -1,x +1 @@\n one\n",
+	} {
+		if err := ApplyUnifiedDiff(b, malformed); !errors.Is(
+			err,
+			ErrorMalformedPatch,
+		) {
+			t.Fatalf("expected malformed patch, got %v for %q", err, malformed)
+		}
+	}
+	helperTestContent(t, b, before)
+
+	// The header of the next file ends the hunk before it, even though it
+	// starts with - and +.
+	patch = "--- a\n+++ b\n@@ -1,2 +1,2 @@\n-one\n+One\n two\n" +
+		"--- c\n+++ d\n@@ -5 +5 @@\n-five\n+Five\n"
+	if err := ApplyUnifiedDiff(b, patch); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	helperTestContent(
+		t,
+		b,
+		"One\ntwo\nthree\nfour\nFive\nsix\nseven\neight\nnine",
+	)
+}
+
+func TestRandomApplyTextEdits(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 5))
+	for range 200 {
+		b := FromString(testString, WithBufferSize(16))
+		reference := []rune(testString)
+
+		// Random non-overlapping edits.
+		var edits []TextEdit
+		pos := 0
+		for pos < len(reference) {
+			start := pos + rng.IntN(10)
+			end := min(start+rng.IntN(4), len(reference))
+			if start > end {
+				break
+			}
+			text := string(rune('a' + rng.IntN(26)))
+			edits = append(edits, TextEdit{start, end, text})
+			pos = end + 1
+		}
+		for i := len(edits) - 1; i >= 0; i-- {
+			e := edits[i]
+			reference = slices.Replace(
+				reference,
+				e.Start,
+				e.End,
+				[]rune(e.NewText)...,
+			)
+		}
+		rng.Shuffle(len(edits), func(i, j int) {
+			edits[i], edits[j] = edits[j], edits[i]
+		})
+
+		if err := ApplyTextEdits(b, edits); err != nil {
+			t.Fatalf("apply failed: %v", err)
+		}
+		helperTestContent(t, b, string(reference))
+		helperTestValid(t, b)
+		b.Undo()
+		helperTestContent(t, b, testString)
+		helperTestValid(t, b)
+	}
+}
+
+func TestSetContent(t *testing.T) {
+	b := FromString(bigString[:5000])
+	helperInsertMiddle(b, "빠져버리는", 100)
+	npieces := len(b.pieces)
+
+	reference := []rune(String(b))
+	reference = slices.Delete(reference, 4000, 4010)
+	reference = slices.Insert(reference, 2000, []rune("daydream")...)
+	SetContent(b, reference)
+
+	helperTestContent(t, b, string(reference))
+	helperTestValid(t, b)
+	// The insertion splits a piece in two and the deletion another.
+	if len(b.pieces) != npieces+3 {
+		t.Fatalf("expected %v pieces, got %v", npieces+3, len(b.pieces))
+	}
+
+	// The diff may align the changes differently, but it's a single edit
+	// within the changed region.
+	info, _ := b.UndoEdit()
+	if info.Kind != KindCompound ||
+		info.Start < 1990 ||
+		info.Start+info.Inserted > 4020 ||
+		info.Inserted-info.Removed != 2 {
+		t.Fatalf("unexpected edit info: %+v", info)
+	}
+	b.Undo()
+	helperTestContent(t, b, bigString[:5000])
+
+	// Setting the same content changes nothing.
+	rev := b.Revision()
+	SetContent(b, []rune(bigString[:5000]))
+	if b.Revision() != rev {
+		t.Fatalf("an edit was made")
+	}
+
+	// Content rewritten completely is too expensive to diff minimally, so
+	// it's diffed in parts.
+	rewritten := []rune(bigString[:5000])
+	slices.Reverse(rewritten)
+	SetContent(b, rewritten)
+	helperTestContent(t, b, string(rewritten))
+	helperTestValid(t, b)
+	b.Undo()
+	helperTestContent(t, b, bigString[:5000])
+}
+
+func TestSetContentLineEndings(t *testing.T) {
+	crlf := strings.ReplaceAll(bigString, "\n", "\r\n")
+	b := FromString(crlf)
+	SetContent(b, []rune(bigString))
+	helperTestContent(t, b, bigString)
+	helperTestValid(t, b)
+
+	// Only the carriage returns are deleted, so the edit keeps a piece of
+	// the original content for each line instead of replacing all of it.
+	lines := strings.Count(bigString, "\n")
+	if b.editedItems != lines {
+		t.Fatalf("expected %v items edited, got %v", lines, b.editedItems)
+	}
+	if len(b.pieces) > lines+1 {
+		t.Fatalf("expected at most %v pieces, got %v", lines+1, len(b.pieces))
+	}
+	for _, p := range b.pieces {
+		if p.buffer != 0 {
+			t.Fatalf("content was inserted: %+v", p)
+		}
+	}
+
+	b.Undo()
+	helperTestContent(t, b, crlf)
+}
+
+func TestReplay(t *testing.T) {
+	b := FromString(testString, WithRecording())
+	rng := rand.New(rand.NewPCG(420, 69))
+	for range 2000 {
+		switch op := rng.IntN(10); {
+		case op < 2:
+			b.Undo()
+		case op < 3:
+			b.Redo()
+		case op < 6:
+			// May be out of bounds, which is recorded too.
+			b.Delete(rng.IntN(b.Size() + 1))
+		default:
+			b.Insert(rng.IntN(b.Size()+1), rune('a'+rng.IntN(26)))
+		}
+	}
+	ApplyTextEdits(b, []TextEdit{{Start: 0, End: 5, NewText: "replayed"}})
+	b.Undo()
+
+	var log strings.Builder
+	if err := WriteLog(&log, b.Recorded()); err != nil {
+		t.Fatal(err)
+	}
+	calls, err := ReadLog[rune](strings.NewReader(log.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != len(b.Recorded()) {
+		t.Fatalf("read %v calls, wrote %v", len(calls), len(b.Recorded()))
+	}
+
+	replayed := FromString(testString)
+	if err := replayed.Replay(calls); err != nil {
+		t.Fatal(err)
+	}
+	helperTestContent(t, replayed, String(b))
+	helperTestValid(t, replayed)
+	if n, m := helperCountUndos(replayed), helperCountUndos(b); n != m {
+		t.Fatalf("replayed table has %v edits, expected %v", n, m)
+	}
+
+	// On other content, some call fails differently.
+	other := FromString("too short")
+	if err := other.Replay(calls); !errors.Is(err, ErrorReplayDiverged) {
+		t.Fatalf("expected ErrorReplayDiverged, got %v", err)
+	}
+
+	_, err = ReadLog[rune](strings.NewReader(`{"call":"insert","idx":1}
+{"call":"jump"}
+`))
+	if !errors.Is(err, ErrorMalformedLog) {
+		t.Fatalf("expected ErrorMalformedLog, got %v", err)
+	}
+}
+
+func TestRecoverPolicies(t *testing.T) {
+	var journal strings.Builder
+	b := FromString(
+		testString,
+		WithJournal(&journal, time.Hour),
+		WithMaxAge(time.Millisecond),
+	)
+	// Neither the policy nor the time can be known when recovering.
+	rng := rand.New(rand.NewPCG(3, 5))
+	b.SetCoalescePolicy(CoalesceFunc[rune](func(c Coalescing[rune]) bool {
+		return rng.IntN(2) == 0
+	}))
+	for i := range 300 {
+		switch op := rng.IntN(10); {
+		case op < 2:
+			b.Undo()
+		case op < 3:
+			b.Redo()
+		case op < 6:
+			idx := rng.IntN(b.Size())
+			b.Delete(idx)
+			b.Delete(idx - rng.IntN(2))
+		default:
+			idx := rng.IntN(b.Size() + 1)
+			b.Insert(idx, 'a')
+			b.Insert(idx+1, 'b')
+		}
+		if i%50 == 0 {
+			time.Sleep(2 * time.Millisecond)
+		}
+		if i == 200 {
+			b.TrimHistory(3)
+		}
+	}
+
+	recovered, _, err := Recover(
+		[]rune(testString),
+		strings.NewReader(journal.String()),
+		WithMaxAge(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperTestContent(t, recovered, String(b))
+	helperTestValid(t, recovered)
+	if n, m := helperCountUndos(recovered), helperCountUndos(b); n != m {
+		t.Fatalf("recovered table has %v edits, expected %v", n, m)
+	}
+}
+
+// Counts the times it's synced.
+type helperSyncedWriter struct {
+	strings.Builder
+	syncs int
+}
+
+func (w *helperSyncedWriter) Sync() error {
+	w.syncs++
+	return nil
+}
+
+func TestJournal(t *testing.T) {
+	var journal helperSyncedWriter
+	b := FromString(testString, WithJournal(&journal, time.Hour))
+	rng := rand.New(rand.NewPCG(420, 69))
+	for range 2000 {
+		switch op := rng.IntN(10); {
+		case op < 2:
+			b.Undo()
+		case op < 3:
+			b.Redo()
+		case op < 6:
+			b.Delete(rng.IntN(b.Size() + 1))
+		default:
+			b.Insert(rng.IntN(b.Size()+1), rune('a'+rng.IntN(26)))
+		}
+	}
+	ApplyTextEdits(b, []TextEdit{{Start: 0, End: 5, NewText: "journaled"}})
+
+	// Only the first write is synced within an hour.
+	if journal.syncs != 1 {
+		t.Fatalf("expected 1 sync, got %v", journal.syncs)
+	}
+	if err := b.SyncJournal(); err != nil || journal.syncs != 2 {
+		t.Fatalf("expected 2 syncs without errors, got %v, %v", journal.syncs, err)
+	}
+
+	recovered, length, err := Recover(
+		[]rune(testString),
+		strings.NewReader(journal.String()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != int64(journal.Len()) {
+		t.Fatalf("valid length is %v, expected %v", length, journal.Len())
+	}
+	helperTestContent(t, recovered, String(b))
+	helperTestValid(t, recovered)
+	if n, m := helperCountUndos(recovered), helperCountUndos(b); n != m {
+		t.Fatalf("recovered table has %v edits, expected %v", n, m)
+	}
+}
+
+func TestRecoverTorn(t *testing.T) {
+	var journal strings.Builder
+	b := FromString("hello", WithJournal(&journal, 0))
+	helperInsertEnd(b, " world")
+	b.Undo()
+	helperInsertEnd(b, "!")
+	complete := journal.String()
+	b.Insert(0, '>')
+
+	// The last record was only partially written.
+	torn := journal.String()[:journal.Len()-3]
+	recovered, length, err := Recover([]rune("hello"), strings.NewReader(torn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != int64(len(complete)) {
+		t.Fatalf("valid length is %v, expected %v", length, len(complete))
+	}
+	helperTestContent(t, recovered, "hello!")
+	recovered.Undo()
+	recovered.Redo()
+	recovered.Redo()
+	helperTestContent(t, recovered, "hello!")
+
+	// The recovered table keeps journaling to the same journal, truncated to
+	// the complete records.
+	journal.Reset()
+	journal.WriteString(torn[:length])
+	recovered, _, err = Recover(
+		[]rune("hello"),
+		strings.NewReader(torn),
+		WithJournal(&journal, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered.Insert(0, '>')
+	recovered.Insert(1, '>')
+	recovered, _, err = Recover(
+		[]rune("hello"),
+		strings.NewReader(journal.String()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperTestContent(t, recovered, ">>hello!")
+
+	// A record is torn if it's not terminated, even if it's complete.
+	recovered, length, err = Recover(
+		[]rune("hello"),
+		strings.NewReader(strings.TrimSuffix(complete, "\n")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperTestContent(t, recovered, "hello")
+	if length >= int64(len(complete)) {
+		t.Fatalf("the unterminated record is in the valid length")
+	}
+
+	// Only the last record may be torn.
+	corrupted := complete[:10] + complete[12:]
+	_, _, err = Recover([]rune("hello"), strings.NewReader(corrupted))
+	if !errors.Is(err, ErrorMalformedLog) {
+		t.Fatalf("expected ErrorMalformedLog, got %v", err)
+	}
+}
+
+// A naive model of a piece table: the content at each position of the undo
+// list, with the edits between them.
+type helperModel struct {
+	states [][]rune
+	edits  []EditInfo
+	top    int
+}
+
+func (m *helperModel) content() []rune {
+	return m.states[m.top]
+}
+
+func (m *helperModel) edit(start, removed int, inserted []rune) {
+	content := slices.Clone(m.content())
+	content = slices.Replace(content, start, start+removed, inserted...)
+	m.states = append(m.states[:m.top+1], content)
+	m.edits = append(m.edits[:m.top], EditInfo{
+		Start:    start,
+		Removed:  removed,
+		Inserted: len(inserted),
+	})
+	m.top++
+}
+
+// Decodes the bytes into operations, three bytes each, and makes them on a
+// piece table, checking it against the model after each one. Edits never
+// coalesce, so each operation is an edit in the model.
+func FuzzEdits(f *testing.F) {
+	alphabet := []rune("ab \n세계")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		var b *PieceTable[rune]
+		initial := ""
+		switch data[0] % 3 {
+		case 0:
+			b = New[rune](WithBufferSize(16))
+		case 1:
+			b = FromString(initial, WithBufferSize(16))
+		default:
+			initial = "hello, 세계"
+			b = FromString(initial, WithBufferSize(16))
+		}
+		b.SetCoalescePolicy(NoCoalescing[rune]())
+		m := &helperModel{states: [][]rune{[]rune(initial)}}
+
+		for data = data[1:]; len(data) >= 3; data = data[3:] {
+			// Indexes may be negative or past the end.
+			op, idx, item := data[0]%5, int(int8(data[1])), int(data[2])
+			size := len(m.content())
+			var err, expected error
+
+			switch op {
+			case 0:
+				r := alphabet[item%len(alphabet)]
+				err = b.Insert(idx, r)
+				if idx < 0 || idx > size {
+					expected = ErrorOutOfBounds
+				} else {
+					m.edit(idx, 0, []rune{r})
+				}
+			case 1:
+				err = b.Delete(idx)
+				if idx < 0 || idx >= size {
+					expected = ErrorOutOfBounds
+				} else {
+					m.edit(idx, 1, nil)
+				}
+			case 2:
+				// Like inserting a slice, as a single edit.
+				items := make([]rune, item%8)
+				for i := range items {
+					items[i] = alphabet[(item+i)%len(alphabet)]
+				}
+				err = ApplyTextEdits(b, []TextEdit{
+					{Start: idx, End: idx, NewText: string(items)},
+				})
+				if idx < 0 || idx > size {
+					expected = ErrorOutOfBounds
+				} else if len(items) > 0 {
+					m.edit(idx, 0, items)
+				}
+			case 3:
+				var end int
+				end, err = b.Undo()
+				if m.top == 0 {
+					expected = ErrorBottomOfUndoList
+				} else {
+					m.top--
+					e := m.edits[m.top]
+					if end != e.Start+e.Removed {
+						t.Fatalf(
+							"undo returned %v, expected %v",
+							end,
+							e.Start+e.Removed,
+						)
+					}
+				}
+			case 4:
+				var end int
+				end, err = b.Redo()
+				if m.top == len(m.edits) {
+					expected = ErrorTopOfUndoList
+				} else {
+					e := m.edits[m.top]
+					m.top++
+					if end != e.Start+e.Inserted {
+						t.Fatalf(
+							"redo returned %v, expected %v",
+							end,
+							e.Start+e.Inserted,
+						)
+					}
+				}
+			}
+
+			if !errors.Is(err, expected) {
+				t.Fatalf(
+					"operation %v at %v returned %v, expected %v",
+					op,
+					idx,
+					err,
+					expected,
+				)
+			}
+			helperTestValid(t, b)
+			helperTestContent(t, b, string(m.content()))
+		}
+	})
+}
+
+// The amounts of pieces benchmarked.
+var helperFragmentation = []int{10, 10_000, 1_000_000}
+
+// Returns a piece table with about the content of bigString made of n pieces,
+// alternating between chunks of the original buffer and single items in the
+// add buffer. It's made without editing, as making a million pieces one edit
+// at a time takes too long, so its undo/redo list is empty.
+func helperFragmented(tb testing.TB, n int) *PieceTable[rune] {
+	original := []rune(bigString)
+	b := FromSlice(original)
+	b.pieces = make([]piece, 0, n)
+	b.size = 0
+
+	chunk := max(len(original)/((n+1)/2)-1, 1)
+	for i := 0; len(b.pieces) < n; i++ {
+		// Never reaching the end of the buffer, so it's not contiguous to
+		// the add buffer.
+		start := (i * chunk) % (len(original) - chunk)
+		b.pieces = append(b.pieces, piece{buffer: 0, start: start, length: chunk})
+		b.size += chunk
+		if len(b.pieces) == n {
+			break
+		}
+
+		buffer := len(b.buffers) - 1
+		b.pieces = append(b.pieces, piece{
+			buffer: buffer,
+			start:  b.buffers[buffer].size(),
+			length: 1,
+		})
+		b.appendToBack('·')
+		b.size++
+	}
+
+	if err := b.validate(); err != nil {
+		tb.Fatalf("invalid piece table: %v", err)
+	}
+	return b
+}
+
+// A rope of runes, as a baseline for the benchmarks. Leaves are split when they
+// grow too much, but the tree is never rebalanced.
+type helperRope struct {
+	left, right *helperRope
+	leaf        []rune
+	size        int
+}
+
+const helperRopeLeaf = 512
+
+func helperNewRope(content []rune) *helperRope {
+	if len(content) <= helperRopeLeaf {
+		return &helperRope{leaf: slices.Clone(content), size: len(content)}
+	}
+	half := len(content) / 2
+	return &helperRope{
+		left:  helperNewRope(content[:half]),
+		right: helperNewRope(content[half:]),
+		size:  len(content),
+	}
+}
+
+func (r *helperRope) get(idx int) rune {
+	for r.left != nil {
+		if idx < r.left.size {
+			r = r.left
+		} else {
+			idx -= r.left.size
+			r = r.right
+		}
+	}
+	return r.leaf[idx]
+}
+
+func (r *helperRope) insert(idx int, c rune) {
+	r.size++
+	if r.left == nil {
+		r.leaf = slices.Insert(r.leaf, idx, c)
+		if len(r.leaf) > 2*helperRopeLeaf {
+			*r = *helperNewRope(r.leaf)
+		}
+		return
+	}
+	if idx <= r.left.size {
+		r.left.insert(idx, c)
+	} else {
+		r.right.insert(idx-r.left.size, c)
+	}
+}
+
+func (r *helperRope) delete(idx int) {
+	r.size--
+	if r.left == nil {
+		r.leaf = slices.Delete(r.leaf, idx, idx+1)
+		return
+	}
+	if idx < r.left.size {
+		r.left.delete(idx)
+	} else {
+		r.right.delete(idx - r.left.size)
+	}
+}
+
+func (r *helperRope) appendTo(content []rune) []rune {
+	if r.left == nil {
+		return append(content, r.leaf...)
+	}
+	return r.right.appendTo(r.left.appendTo(content))
+}
+
+// Runs the benchmark on piece tables at every fragmentation level.
+func helperBenchFragmented(
+	b *testing.B,
+	bench func(b *testing.B, table *PieceTable[rune]),
+) {
+	for _, n := range helperFragmentation {
+		b.Run(fmt.Sprintf("pieces=%v", n), func(b *testing.B) {
+			table := helperFragmented(b, n)
+			b.ReportAllocs()
+			bench(b, table)
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	rng := rand.New(rand.NewPCG(420, 69))
+	helperBenchFragmented(b, func(b *testing.B, table *PieceTable[rune]) {
+		for b.Loop() {
+			table.Get(rng.IntN(table.Size()))
+		}
+	})
+
+	content := []rune(bigString)
+	b.Run("naive", func(b *testing.B) {
+		b.ReportAllocs()
+		var r rune
+		for b.Loop() {
+			r = content[rng.IntN(len(content))]
+		}
+		_ = r
+	})
+	b.Run("rope", func(b *testing.B) {
+		rope := helperNewRope(content)
+		b.ReportAllocs()
+		for b.Loop() {
+			rope.get(rng.IntN(rope.size))
+		}
+	})
+	b.Run("gap", func(b *testing.B) {
+		gap := GapBufferFromSlice(content)
+		b.ReportAllocs()
+		for b.Loop() {
+			gap.Get(rng.IntN(gap.Size()))
+		}
+	})
+}
+
+func BenchmarkInsert(b *testing.B) {
+	rng := rand.New(rand.NewPCG(420, 69))
+	helperBenchFragmented(b, func(b *testing.B, table *PieceTable[rune]) {
+		for b.Loop() {
+			table.Insert(rng.IntN(table.Size()+1), 'a')
+		}
+	})
+
+	b.Run("naive", func(b *testing.B) {
+		content := []rune(bigString)
+		b.ReportAllocs()
+		for b.Loop() {
+			content = slices.Insert(content, rng.IntN(len(content)+1), 'a')
+		}
+	})
+	b.Run("rope", func(b *testing.B) {
+		rope := helperNewRope([]rune(bigString))
+		b.ReportAllocs()
+		for b.Loop() {
+			rope.insert(rng.IntN(rope.size+1), 'a')
+		}
+	})
+	b.Run("gap", func(b *testing.B) {
+		gap := GapBufferFromSlice([]rune(bigString))
+		b.ReportAllocs()
+		for b.Loop() {
+			gap.Insert(rng.IntN(gap.Size()+1), 'a')
+		}
+	})
+}
+
+func BenchmarkDelete(b *testing.B) {
+	rng := rand.New(rand.NewPCG(420, 69))
+	for _, n := range helperFragmentation {
+		b.Run(fmt.Sprintf("pieces=%v", n), func(b *testing.B) {
+			table := helperFragmented(b, n)
+			b.ReportAllocs()
+			for b.Loop() {
+				if table.Size() == 0 {
+					b.StopTimer()
+					table = helperFragmented(b, n)
+					b.StartTimer()
+				}
+				table.Delete(rng.IntN(table.Size()))
+			}
+		})
+	}
+
+	b.Run("naive", func(b *testing.B) {
+		content := []rune(bigString)
+		b.ReportAllocs()
+		for b.Loop() {
+			if len(content) == 0 {
+				content = []rune(bigString)
+			}
+			idx := rng.IntN(len(content))
+			content = slices.Delete(content, idx, idx+1)
+		}
+	})
+	b.Run("rope", func(b *testing.B) {
+		rope := helperNewRope([]rune(bigString))
+		b.ReportAllocs()
+		for b.Loop() {
+			if rope.size == 0 {
+				rope = helperNewRope([]rune(bigString))
+			}
+			rope.delete(rng.IntN(rope.size))
+		}
+	})
+	b.Run("gap", func(b *testing.B) {
+		gap := GapBufferFromSlice([]rune(bigString))
+		b.ReportAllocs()
+		for b.Loop() {
+			if gap.Size() == 0 {
+				gap = GapBufferFromSlice([]rune(bigString))
+			}
+			gap.Delete(rng.IntN(gap.Size()))
+		}
+	})
+}
+
+// Makes edits that never coalesce on the piece table, so there's something to
+// undo.
+func helperMakeEdits(table *PieceTable[rune], rng *rand.Rand, n int) {
+	table.SetCoalescePolicy(NoCoalescing[rune]())
+	for range n {
+		table.Insert(rng.IntN(table.Size()+1), 'a')
+	}
+}
+
+func BenchmarkUndo(b *testing.B) {
+	rng := rand.New(rand.NewPCG(420, 69))
+	helperBenchFragmented(b, func(b *testing.B, table *PieceTable[rune]) {
+		helperMakeEdits(table, rng, 1000)
+		for b.Loop() {
+			if _, err := table.Undo(); err != nil {
+				b.StopTimer()
+				for table.undoTop < len(table.edits) {
+					table.RedoEdit()
+				}
+				b.StartTimer()
+			}
+		}
+	})
+}
+
+func BenchmarkRedo(b *testing.B) {
+	rng := rand.New(rand.NewPCG(420, 69))
+	helperBenchFragmented(b, func(b *testing.B, table *PieceTable[rune]) {
+		helperMakeEdits(table, rng, 1000)
+		for b.Loop() {
+			if _, err := table.Redo(); err != nil {
+				b.StopTimer()
+				for table.undoTop > 0 {
+					table.UndoEdit()
+				}
+				b.StartTimer()
+			}
+		}
+	})
+}
+
+func BenchmarkContent(b *testing.B) {
+	helperBenchFragmented(b, func(b *testing.B, table *PieceTable[rune]) {
+		for b.Loop() {
+			Content(table)
+		}
+	})
+
+	b.Run("naive", func(b *testing.B) {
+		content := []rune(bigString)
+		b.ReportAllocs()
+		for b.Loop() {
+			_ = slices.Clone(content)
+		}
+	})
+	b.Run("rope", func(b *testing.B) {
+		rope := helperNewRope([]rune(bigString))
+		b.ReportAllocs()
+		for b.Loop() {
+			rope.appendTo(make([]rune, 0, rope.size))
+		}
+	})
+}
+
+func BenchmarkString(b *testing.B) {
+	helperBenchFragmented(b, func(b *testing.B, table *PieceTable[rune]) {
+		for b.Loop() {
+			String(table)
+		}
+	})
+
+	b.Run("naive", func(b *testing.B) {
+		content := []rune(bigString)
+		b.ReportAllocs()
+		for b.Loop() {
+			_ = string(content)
+		}
+	})
+	b.Run("rope", func(b *testing.B) {
+		rope := helperNewRope([]rune(bigString))
+		b.ReportAllocs()
+		for b.Loop() {
+			_ = string(rope.appendTo(make([]rune, 0, rope.size)))
+		}
+	})
+}
+
+func helperTestSequence(t *testing.T, s Sequence[rune], expected []rune) {
+	t.Helper()
+	if s.Size() != len(expected) {
+		t.Fatalf("size is %v, expected %v", s.Size(), len(expected))
+	}
+	n := 0
+	for i, c := range s.All() {
+		if i != n || c != expected[i] {
+			t.Fatalf("item %v is %q, expected %q", i, c, expected[i])
+		}
+		if got, err := s.Get(i); err != nil || got != c {
+			t.Fatalf("get %v returned %q, %v", i, got, err)
+		}
+		n++
+	}
+	if n != len(expected) {
+		t.Fatalf("iterated %v items, expected %v", n, len(expected))
+	}
+}
+
+// Makes the same random calls on a piece table and a gap buffer, which must
+// return the same and have the same content.
+func TestSequences(t *testing.T) {
+	table := FromString(testString, WithBufferSize(16))
+	gap := GapBufferFromSlice([]rune(testString))
+	sequences := []Sequence[rune]{table, gap}
+
+	rng := rand.New(rand.NewPCG(420, 69))
+	position := 0
+	for range 5000 {
+		op := rng.IntN(100)
+		if rng.IntN(10) < 2 {
+			// May be out of bounds.
+			position = rng.IntN(table.Size()+3) - 1
+		}
+
+		var results [2]int
+		var errs [2]error
+		for i, s := range sequences {
+			switch {
+			case op < 15:
+				results[i], errs[i] = s.Undo()
+			case op < 25:
+				results[i], errs[i] = s.Redo()
+			case op < 60:
+				// Like the backspace key.
+				errs[i] = s.Delete(position - 1)
+			default:
+				errs[i] = s.Insert(position, rune('a'+op%26))
+			}
+		}
+		switch {
+		case op >= 60:
+			position++
+		case op >= 25:
+			position--
+		}
+
+		if results[0] != results[1] || !errors.Is(errs[1], errs[0]) {
+			t.Fatalf(
+				"gap buffer returned %v, %v, piece table %v, %v",
+				results[1],
+				errs[1],
+				results[0],
+				errs[0],
+			)
+		}
+		helperTestSequence(t, gap, Content(table))
+	}
+}
+
+func TestGapBuffer(t *testing.T) {
+	content := []rune(bigString)[:1000]
+	g := NewGapBuffer[rune]()
+	// Enough to grow a few times.
+	for i, c := range content {
+		g.Insert(i, c)
+	}
+	g.Insert(0, '>')
+	helperTestSequence(t, g, append([]rune{'>'}, content...))
+
+	g.Undo()
+	g.Undo()
+	helperTestSequence(t, g, nil)
+	g.Redo()
+	helperTestSequence(t, g, content)
+
+	// Deletions with the delete key are merged only with ForwardDeletes.
+	g.SetCoalescePolicy(ForwardDeletes(DefaultCoalescing[rune]()))
+	for range 10 {
+		g.Delete(5)
+	}
+	g.Undo()
+	helperTestSequence(t, g, content)
+}
+
+func TestClone(t *testing.T) {
+	b := FromString("hello world", WithBufferSize(16))
+	helperInsertEnd(b, "!")
+	before := b.Snapshot()
+
+	c := b.Clone()
+	// Both append to what was the same add buffer. The original keeps
+	// appending in place, and the copy copies it.
+	add := &b.buffers[len(b.buffers)-1].content[0]
+	helperInsertEnd(c, "?")
+	helperInsertEnd(b, " bye")
+	if &b.buffers[len(b.buffers)-1].content[0] != add {
+		t.Fatalf("the add buffer of the original was copied")
+	}
+	if &c.buffers[len(c.buffers)-1].content[0] == add {
+		t.Fatalf("the add buffer of the copy was not copied")
+	}
+	c.Delete(0)
+	helperTestContent(t, b, "hello world! bye")
+	helperTestContent(t, c, "ello world!?")
+	helperTestValid(t, b)
+	helperTestValid(t, c)
+
+	// The undo/redo lists are independent too. The edits made on the original
+	// may still be merged.
+	b.Undo()
+	helperTestContent(t, b, "hello world")
+	helperTestContent(t, c, "ello world!?")
+	c.Undo()
+	c.Undo()
+	c.Undo()
+	helperTestContent(t, c, "hello world")
+	c.Redo()
+	helperTestContent(t, c, "hello world!")
+	helperTestContent(t, b, "hello world")
+
+	// Snapshots taken before cloning are not affected.
+	for range 20 {
+		helperInsertEnd(b, "b")
+		helperInsertEnd(c, "c")
+	}
+	if s := string(before.Content()); s != "hello world!" {
+		t.Fatalf("snapshot changed to %q", s)
+	}
+	hunks := Diff(before, c.Snapshot())
+	if len(hunks) != 1 || hunks[0].BLength != 20 {
+		t.Fatalf("unexpected diff: %+v", hunks)
+	}
+}
+
+func TestCloneCompact(t *testing.T) {
+	b := FromString("hello world")
+	helperInsertMiddle(b, "XYZ", 5)
+	b.Undo()
+	b.TrimHistory(0)
+	helperInsertMiddle(b, "abcdef", 5)
+	b.Delete(7)
+
+	// Compacting one of them must not change the undo/redo list of the other.
+	c := b.Clone()
+	c.Compact()
+	b.Undo()
+	helperTestContent(t, b, "helloabcdef world")
+	helperTestValid(t, b)
+	c.Undo()
+	helperTestContent(t, c, "helloabcdef world")
+	helperTestValid(t, c)
+
+	b.Compact()
+	c.Undo()
+	helperTestContent(t, c, "hello world")
+	b.Undo()
+	helperTestContent(t, b, "hello world")
+}
+
+func TestSlice(t *testing.T) {
+	// Small buffers so pieces cross them.
+	b := FromString(testString, WithBufferSize(16))
+	rng := rand.New(rand.NewPCG(420, 69))
+	for range 500 {
+		if rng.IntN(3) == 0 {
+			b.Delete(rng.IntN(b.Size()))
+		} else {
+			b.Insert(rng.IntN(b.Size()+1), rune('a'+rng.IntN(26)))
+		}
+	}
+	content := Content(b)
+
+	var buffer []rune
+	for range 1000 {
+		start := rng.IntN(len(content) + 1)
+		end := start + rng.IntN(len(content)-start+1)
+		expected := content[start:end]
+
+		s, err := b.Slice(start, end)
+		if err != nil || !slices.Equal(s, expected) {
+			t.Fatalf("slice [%v, %v) is %q, %v", start, end, s, err)
+		}
+		buffer, err = b.AppendSlice(buffer[:0], start, end)
+		if err != nil || !slices.Equal(buffer, expected) {
+			t.Fatalf("appended [%v, %v) is %q, %v", start, end, buffer, err)
+		}
+		str, err := Substring(b, start, end)
+		if err != nil || str != string(expected) {
+			t.Fatalf("substring [%v, %v) is %q, %v", start, end, str, err)
+		}
+	}
+
+	prefix := []rune("> ")
+	appended, _ := b.AppendSlice(prefix, 0, 3)
+	if string(appended) != "> "+string(content[:3]) {
+		t.Fatalf("appended %q", string(appended))
+	}
+	for _, r := range [][2]int{{-1, 2}, {3, 2}, {0, len(content) + 1}} {
+		if _, err := b.Slice(r[0], r[1]); !errors.Is(err, ErrorOutOfBounds) {
+			t.Fatalf("slice %v returned %v", r, err)
+		}
+		if _, err := Substring(b, r[0], r[1]); !errors.Is(err, ErrorOutOfBounds) {
+			t.Fatalf("substring %v returned %v", r, err)
+		}
+	}
+}
+
+// Returns the lines of the text in [fromLine, toLine), with or without the
+// terminators.
+func helperLines(
+	text string,
+	fromLine int,
+	toLine int,
+	terminators bool,
+) []string {
+	lines := strings.SplitAfter(text, "\n")
+	var expected []string
+	for i := max(fromLine, 0); i < min(toLine, len(lines)); i++ {
+		if terminators {
+			expected = append(expected, lines[i])
+		} else {
+			expected = append(expected, strings.TrimSuffix(lines[i], "\n"))
+		}
+	}
+	return expected
+}
+
+func helperTestLines(t *testing.T, b *PieceTable[rune], from, to int) {
+	t.Helper()
+	for _, terminators := range []bool{false, true} {
+		expected := helperLines(String(b), from, to, terminators)
+
+		var got []string
+		n := max(from, 0)
+		for line, text := range Lines(b, from, to, terminators) {
+			if line != n {
+				t.Fatalf("line %v yielded as %v", n, line)
+			}
+			got = append(got, text)
+			n++
+		}
+		if !slices.Equal(got, expected) {
+			t.Fatalf(
+				"lines [%v, %v) are %q, expected %q",
+				from,
+				to,
+				got,
+				expected,
+			)
+		}
+
+		got = got[:0]
+		for _, segments := range LineSegments(b, from, to, terminators) {
+			var text []rune
+			for _, s := range segments {
+				text = append(text, s...)
+			}
+			got = append(got, string(text))
+		}
+		if !slices.Equal(got, expected) {
+			t.Fatalf(
+				"segments [%v, %v) are %q, expected %q",
+				from,
+				to,
+				got,
+				expected,
+			)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	b := FromString("")
+	if n := LineCount(b); n != 1 {
+		t.Fatalf("empty table has %v lines", n)
+	}
+	helperTestLines(t, b, 0, 1)
+
+	b = FromString(testString, WithBufferSize(16))
+	helperTestLines(t, b, 0, 100)
+	helperTestLines(t, b, 2, 4)
+	helperTestLines(t, b, -1, 1)
+
+	rng := rand.New(rand.NewPCG(420, 69))
+	for i := range 2000 {
+		switch op := rng.IntN(10); {
+		case op < 3 && b.Size() > 0:
+			b.Delete(rng.IntN(b.Size()))
+		case op < 4:
+			b.Undo()
+		case op < 5:
+			b.Redo()
+		default:
+			r := rune('a' + rng.IntN(26))
+			if rng.IntN(5) == 0 {
+				r = '\n'
+			}
+			b.Insert(rng.IntN(b.Size()+1), r)
+		}
+		if i%500 == 0 {
+			b.Compact()
+		}
+
+		if n := LineCount(b); n != strings.Count(String(b), "\n")+1 {
+			t.Fatalf("counted %v lines", n)
+		}
+		from := rng.IntN(LineCount(b) + 1)
+		helperTestLines(t, b, from, from+rng.IntN(5))
+	}
+
+	// Clones have their own index.
+	c := b.Clone()
+	helperInsertEnd(c, "\nclone")
+	helperTestLines(t, c, 0, LineCount(c))
+	helperTestLines(t, b, 0, LineCount(b))
+}
+
+func BenchmarkLines(b *testing.B) {
+	helperBenchFragmented(b, func(b *testing.B, table *PieceTable[rune]) {
+		middle := LineCount(table) / 2
+		for b.Loop() {
+			for range Lines(table, middle, middle+50, false) {
+			}
+		}
+	})
+}
+
+func TestSegments(t *testing.T) {
+	// Small buffers so pieces cross them.
+	b := FromString(testString, WithBufferSize(16))
+	rng := rand.New(rand.NewPCG(420, 69))
+	for range 500 {
+		if rng.IntN(3) == 0 {
+			b.Delete(rng.IntN(b.Size()))
+		} else {
+			b.Insert(rng.IntN(b.Size()+1), rune('a'+rng.IntN(26)))
+		}
+	}
+	content := Content(b)
+
+	for range 1000 {
+		// May be out of bounds, which is clamped.
+		start := rng.IntN(len(content)+20) - 10
+		end := start + rng.IntN(len(content)+20)
+		from := min(max(start, 0), len(content))
+		expected := content[from:min(max(end, from), len(content))]
+
+		var got []rune
+		for s := range b.Segments(start, end) {
+			if len(s) == 0 || cap(s) != len(s) {
+				t.Fatalf(
+					"segment has length %v and capacity %v",
+					len(s),
+					cap(s),
+				)
+			}
+			got = append(got, s...)
+		}
+		if !slices.Equal(got, expected) {
+			t.Fatalf(
+				"segments [%v, %v) are %q, expected %q",
+				start,
+				end,
+				got,
+				expected,
+			)
+		}
+	}
+
+	// The same iterator may be used again.
+	seq := b.Segments(10, 40)
+	for range 2 {
+		var got []rune
+		for s := range seq {
+			got = append(got, s...)
+		}
+		if !slices.Equal(got, content[10:40]) {
+			t.Fatalf("segments are %q, expected %q", got, content[10:40])
+		}
+	}
+	// Even after edits, as the pieces are found when it's ranged.
+	for b.Size() > 20 {
+		b.Delete(0)
+	}
+	b.Insert(0, '>')
+	var got []rune
+	for s := range seq {
+		got = append(got, s...)
+	}
+	if expected := Content(b)[10:]; !slices.Equal(got, expected) {
+		t.Fatalf("segments are %q, expected %q", got, expected)
+	}
+
+	// Each segment is a subslice of a buffer, so the first yielded is the
+	// original buffer itself.
+	b = FromString("hello")
+	helperInsertEnd(b, " world")
+	for s := range b.Segments(0, 5) {
+		if &s[0] != &b.buffers[0].content[0] {
+			t.Fatalf("segment is a copy")
+		}
+		break
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	for _, c := range []struct {
+		text     string
+		expected LineEnding
+	}{
+		{"", LineEndingLF},
+		{"no breaks", LineEndingLF},
+		{"a\nb\r\nc\r\n", LineEndingCRLF},
+		{"a\rb\rc\n", LineEndingCR},
+		{"a\r\nb\nc\n", LineEndingLF},
+		{"ends with\r", LineEndingCR},
+	} {
+		b := FromString(c.text)
+		if e := DetectLineEnding(b); e != c.expected {
+			t.Fatalf("detected %v in %q, expected %v", e, c.text, c.expected)
+		}
+	}
+
+	// The breaks may be split in pieces.
+	b := FromString("one\r\ntwo\rthree\n")
+	b.Insert(4, 'x')
+	b.Delete(4)
+	rev := b.Revision()
+	for _, c := range []struct {
+		ending   LineEnding
+		expected string
+	}{
+		{LineEndingLF, "one\ntwo\nthree\n"},
+		{LineEndingCRLF, "one\r\ntwo\r\nthree\r\n"},
+		{LineEndingCR, "one\rtwo\rthree\r"},
+	} {
+		var builder strings.Builder
+		n, err := WriteLineEnding(&builder, b, c.ending)
+		if err != nil || builder.String() != c.expected {
+			t.Fatalf("wrote %q, %v, expected %q", builder.String(), err, c.expected)
+		}
+		if n != int64(len(c.expected)) {
+			t.Fatalf("wrote %v bytes, expected %v", n, len(c.expected))
+		}
+	}
+	helperTestContent(t, b, "one\r\ntwo\rthree\n")
+	if b.Revision() != rev {
+		t.Fatalf("writing changed the piece table")
+	}
+}
+
+func TestCRLFLines(t *testing.T) {
+	b := FromString("one\r\ntwo\n\r\nthree")
+	var lines []string
+	for _, line := range Lines(b, 0, LineCount(b), false) {
+		lines = append(lines, line)
+	}
+	if expected := []string{"one", "two", "", "three"}; !slices.Equal(
+		lines,
+		expected,
+	) {
+		t.Fatalf("lines are %q, expected %q", lines, expected)
+	}
+	for _, line := range Lines(b, 0, 1, true) {
+		if line != "one\r\n" {
+			t.Fatalf("line with terminator is %q", line)
+		}
+	}
+
+	// Backspace right after a CRLF, and delete right before one. Each CRLF
+	// is a single edit, whatever the coalescing policy.
+	b.SetCoalescePolicy(NoCoalescing[rune]())
+	idx, err := DeleteLineAware(b, 4)
+	if err != nil || idx != 3 {
+		t.Fatalf("deleted at %v, %v", idx, err)
+	}
+	helperTestContent(t, b, "onetwo\n\r\nthree")
+	idx, _ = DeleteLineAware(b, 7)
+	if idx != 7 {
+		t.Fatalf("deleted at %v", idx)
+	}
+	helperTestContent(t, b, "onetwo\nthree")
+	// Lone breaks are deleted alone.
+	DeleteLineAware(b, 6)
+	helperTestContent(t, b, "onetwothree")
+
+	b.Undo()
+	helperTestContent(t, b, "onetwo\nthree")
+	b.Undo()
+	helperTestContent(t, b, "onetwo\n\r\nthree")
+	b.Undo()
+	helperTestContent(t, b, "one\r\ntwo\n\r\nthree")
+	DeleteLineAware(b, 3)
+	helperTestContent(t, b, "onetwo\n\r\nthree")
+	b.Undo()
+	helperTestContent(t, b, "one\r\ntwo\n\r\nthree")
+	helperTestValid(t, b)
+
+	if _, err := DeleteLineAware(b, b.Size()); !errors.Is(err, ErrorOutOfBounds) {
+		t.Fatalf("expected ErrorOutOfBounds, got %v", err)
+	}
+
+	// Otherwise, a CRLF is merged with the deletions around it like a LF,
+	// with backspace and with the delete key.
+	b = FromString("foo\r\nbar", WithRecording())
+	for idx := b.Size(); idx > 0; {
+		idx, _ = DeleteLineAware(b, idx-1)
+	}
+	b.SetCoalescePolicy(ForwardDeletes(DefaultCoalescing[rune]()))
+	helperInsertEnd(b, "foo\r\nbar")
+	for b.Size() > 0 {
+		DeleteLineAware(b, 0)
+	}
+	helperTestValid(t, b)
+
+	replayed := FromString("foo\r\nbar")
+	if err := replayed.Replay(b.Recorded()); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*PieceTable[rune]{b, replayed} {
+		if n := helperCountUndos(b); n != 3 {
+			t.Fatalf("expected 3 edits, got %v", n)
+		}
+		helperTestContent(t, b, "foo\r\nbar")
+	}
+}
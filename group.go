@@ -0,0 +1,217 @@
+package gopiecetable
+
+import (
+	"slices"
+	"time"
+)
+
+// Represents a group of insertions and deletions that are undone and redone at
+// once, implements edit.
+type compound struct {
+	idx      int       // The first index affected.
+	removed  int       // The amount of items removed from idx, as a whole.
+	inserted int       // The amount of items inserted at idx, as a whole.
+	edited   int       // The amount of items inserted and deleted, one by one.
+	time     time.Time // When it was made.
+	states   cursorStates
+	rev      uint64
+	span
+}
+
+func (c compound) info() EditInfo {
+	return EditInfo{
+		Kind:     KindCompound,
+		Start:    c.idx,
+		Removed:  c.removed,
+		Inserted: c.inserted,
+	}
+}
+
+func (c compound) changes() span {
+	return c.span
+}
+
+func (c compound) withChanges(s span) edit {
+	c.span = s
+	return c
+}
+
+func (c compound) items() int {
+	return c.edited
+}
+
+func (c compound) lastChanged() time.Time {
+	return c.time
+}
+
+func (c compound) cursor() cursorStates {
+	return c.states
+}
+
+func (c compound) withCursor(s cursorStates) edit {
+	c.states = s
+	return c
+}
+
+func (c compound) revision() uint64 {
+	return c.rev
+}
+
+// Replaces the items in [start, end) with content.
+type replacement[Content any] struct {
+	start   int
+	end     int
+	content []Content
+}
+
+// Applies the replacements as a single edit. They must be sorted, must not
+// overlap and must be in bounds. Does nothing if there's nothing to replace.
+func (b *PieceTable[Content]) replaceGrouped(reps []replacement[Content]) {
+	// Replacements that don't replace anything are not worth an edit.
+	var effective []replacement[Content]
+	for _, r := range reps {
+		if r.start != r.end || len(r.content) > 0 {
+			effective = append(effective, r)
+		}
+	}
+	if len(effective) == 0 {
+		return
+	}
+	b.normalizeUndo()
+	g := compound{
+		idx:    effective[0].start,
+		states: cursorStates{before: b.cursorState},
+		time:   time.Now(),
+	}
+	g.removed = effective[len(effective)-1].end - g.idx
+	g.inserted = g.removed
+	for _, r := range effective {
+		g.inserted += len(r.content) - (r.end - r.start)
+		g.edited += r.end - r.start + len(r.content)
+	}
+
+	g.span = b.splice(effective)
+	b.size += g.inserted - g.removed
+	g.rev = b.nextRevision()
+	b.edits = append(b.edits, g)
+	b.undoTop++
+	b.editedItems += g.edited
+	// The next insertion or deletion is never merged into the group.
+	b.coalescing = false
+	b.awaitingCursor = true
+	b.limitHistory()
+
+	// Recorded after the limits are enforced, so the edits they discarded are
+	// recorded with it.
+	c := Call[Content]{Kind: CallGroup}
+	if b.options.recording || b.options.journal != nil {
+		for _, r := range effective {
+			c.Group = append(c.Group, Replacement[Content]{
+				Start: r.start,
+				End:   r.end,
+				Items: slices.Clone(r.content),
+			})
+		}
+	}
+	b.record(c, nil)
+}
+
+// Replaces the pieces of the items the replacements remove with the pieces of
+// the items they keep and the ones they insert, appended to the add buffer,
+// returning the span of the change. The pieces right before and after are
+// replaced too, so the new pieces are merged with them if contiguous.
+func (b *PieceTable[Content]) splice(reps []replacement[Content]) span {
+	first, last := reps[0].start, reps[len(reps)-1].end
+
+	// The piece with the first item replaced, or right after it if it's an
+	// insertion at a boundary, and the one before it.
+	pStart, pos := 0, 0
+	for pStart < len(b.pieces) && pos+b.pieces[pStart].length <= first {
+		pos += b.pieces[pStart].length
+		pStart++
+	}
+	if pStart > 0 {
+		pStart--
+		pos -= b.pieces[pStart].length
+	}
+	// Up to the piece with the last item replaced, and the one after it.
+	pEnd, end := pStart, pos
+	for pEnd < len(b.pieces) && end <= last {
+		end += b.pieces[pEnd].length
+		pEnd++
+	}
+
+	var after []piece
+	push := func(p piece) {
+		if p.length == 0 {
+			return
+		}
+		if n := len(after); n > 0 && b.contiguous(after[n-1], p) {
+			after[n-1].length += p.length
+			return
+		}
+		after = append(after, p)
+	}
+
+	// Pushes the pieces of the items in [from, to) of the region, which are
+	// asked for in order.
+	i, at := pStart, pos // The current piece and where it starts.
+	keep := func(from, to int) {
+		for from < to {
+			p := b.pieces[i]
+			if from >= at+p.length {
+				at += p.length
+				i++
+				continue
+			}
+			n := min(at+p.length, to) - from
+			buf, start := b.indexByPiece(p, from-at)
+			push(piece{buffer: buf, start: start, length: n})
+			from += n
+		}
+	}
+
+	cur := pos
+	for _, r := range reps {
+		keep(cur, r.start)
+		if len(r.content) > 0 {
+			buffer := len(b.buffers) - 1
+			p := piece{
+				buffer: buffer,
+				start:  b.buffers[buffer].size(),
+				length: len(r.content),
+			}
+			for _, c := range r.content {
+				b.appendToBack(c)
+			}
+			push(p)
+		}
+		cur = r.end
+	}
+	keep(cur, end)
+
+	before := slices.Clone(b.pieces[pStart:pEnd])
+	b.pieces = slices.Replace(b.pieces, pStart, pEnd, after...)
+	return span{piecIdx: pStart, before: before, after: after}
+}
+
+// SetContent replaces the content of the piece table with content, changing
+// only the regions where they differ, as a single edit. Unlike deleting
+// everything and inserting the new content, the pieces of the unchanged
+// regions are kept and the edit stores only what changed, so it's the way to
+// reload content rewritten by someone else.
+func SetContent[Content comparable](
+	b *PieceTable[Content],
+	content []Content,
+) {
+	hunks := diff(b.slice(0, b.size), content)
+	reps := make([]replacement[Content], 0, len(hunks))
+	for _, h := range hunks {
+		reps = append(reps, replacement[Content]{
+			start:   h.AStart,
+			end:     h.AStart + h.ALength,
+			content: content[h.BStart : h.BStart+h.BLength],
+		})
+	}
+	b.replaceGrouped(reps)
+}
@@ -0,0 +1,75 @@
+package gopiecetable
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Writes the call to the journal as a single line, syncing it if it's time.
+func (b *PieceTable[Content]) journal(c Call[Content]) {
+	if b.journalErr != nil {
+		return
+	}
+	line, err := json.Marshal(c)
+	if err != nil {
+		b.journalErr = err
+		return
+	}
+	// A single write, so a crash may only tear the last line.
+	if _, err := b.options.journal.Write(append(line, '\n')); err != nil {
+		b.journalErr = err
+		return
+	}
+	if time.Since(b.journalSynced) >= b.options.journalSync {
+		b.journalErr = b.syncJournal()
+	}
+}
+
+// SyncJournal syncs the journal set with WithJournal, if it has a Sync method.
+// Returns the first error writing or syncing the journal, after which nothing
+// else is written to it.
+func (b *PieceTable[Content]) SyncJournal() error {
+	if b.journalErr == nil && b.options.journal != nil {
+		b.journalErr = b.syncJournal()
+	}
+	return b.journalErr
+}
+
+func (b *PieceTable[Content]) syncJournal() error {
+	b.journalSynced = time.Now()
+	if s, ok := b.options.journal.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Recover rebuilds a piece table from its original content and the journal it
+// wrote with WithJournal, including its undo/redo list. The last record of the
+// journal is ignored if it was torn by a crash. The options are applied to the
+// piece table, and it only starts journaling after being rebuilt. The edits are
+// merged as they were before the crash, whatever the coalescing policy, see
+// Replay.
+//
+// Also returns the length of the journal up to the end of the last complete
+// record. To keep appending to the same journal, it must be truncated to that
+// length first, or the next record would be appended to the torn one.
+func Recover[Content any](
+	original []Content,
+	journal io.Reader,
+	opts ...Option,
+) (*PieceTable[Content], int64, error) {
+	calls, length, err := readLog[Content](journal, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b := FromSlice(original, opts...)
+	w := b.options.journal
+	b.options.journal = nil
+	if err := b.Replay(calls); err != nil {
+		return nil, 0, err
+	}
+	b.options.journal = w
+	return b, length, nil
+}
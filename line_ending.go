@@ -0,0 +1,176 @@
+package gopiecetable
+
+import (
+	"bufio"
+	"io"
+)
+
+// LineEnding is a kind of line break.
+type LineEnding int
+
+const (
+	LineEndingLF   LineEnding = iota // "\n", as in Unix.
+	LineEndingCRLF                   // "\r\n", as in Windows.
+	LineEndingCR                     // "\r", as in old Macs.
+)
+
+func (e LineEnding) String() string {
+	switch e {
+	case LineEndingCRLF:
+		return "CRLF"
+	case LineEndingCR:
+		return "CR"
+	default:
+		return "LF"
+	}
+}
+
+// Returns the runes of the line break.
+func (e LineEnding) text() string {
+	switch e {
+	case LineEndingCRLF:
+		return "\r\n"
+	case LineEndingCR:
+		return "\r"
+	default:
+		return "\n"
+	}
+}
+
+// Calls f with each line break in the runes, found across the calls to feed,
+// and each other rune. Lone CRs are only known once the next rune is fed, or
+// on end.
+type breakScanner struct {
+	pendingCR bool
+	f         func(r rune, ending LineEnding, isBreak bool)
+}
+
+func (s *breakScanner) feed(runes []rune) {
+	for _, r := range runes {
+		switch {
+		case r == '\n' && s.pendingCR:
+			s.pendingCR = false
+			s.f(0, LineEndingCRLF, true)
+		case r == '\n':
+			s.f(0, LineEndingLF, true)
+		default:
+			s.end()
+			if r == '\r' {
+				s.pendingCR = true
+			} else {
+				s.f(r, 0, false)
+			}
+		}
+	}
+}
+
+func (s *breakScanner) end() {
+	if s.pendingCR {
+		s.pendingCR = false
+		s.f(0, LineEndingCR, true)
+	}
+}
+
+// DetectLineEnding returns the line ending most used in a PieceTable[rune],
+// e.g., to write it back the same way it was read with WriteLineEnding.
+// Returns LineEndingLF if there are no line breaks. Unlike LineCount and Lines,
+// a lone CR counts as a line break.
+//
+// The line ending is not stored: the whole content is scanned on each call, so
+// it's meant to be called once after loading, keeping the result to save with.
+func DetectLineEnding(b *PieceTable[rune]) LineEnding {
+	var counts [3]int
+	scanner := breakScanner{f: func(_ rune, ending LineEnding, isBreak bool) {
+		if isBreak {
+			counts[ending]++
+		}
+	}}
+	for s := range b.segments(0, b.size) {
+		scanner.feed(s)
+	}
+	scanner.end()
+
+	dominant := LineEndingLF
+	for _, e := range []LineEnding{LineEndingCRLF, LineEndingCR} {
+		if counts[e] > counts[dominant] {
+			dominant = e
+		}
+	}
+	return dominant
+}
+
+// WriteLineEnding writes the content of a PieceTable[rune] to w as UTF-8,
+// converting every line break, be it LF, CRLF or CR, to ending. The piece
+// table is not changed, so it's the way to save with another line ending
+// without an edit in the undo/redo list. Returns the amount of bytes written.
+func WriteLineEnding(
+	w io.Writer,
+	b *PieceTable[rune],
+	ending LineEnding,
+) (int64, error) {
+	writer := bufio.NewWriter(w)
+	var written int64
+	var err error
+	scanner := breakScanner{f: func(r rune, _ LineEnding, isBreak bool) {
+		if err != nil {
+			return
+		}
+		var n int
+		if isBreak {
+			n, err = writer.WriteString(ending.text())
+		} else {
+			n, err = writer.WriteRune(r)
+		}
+		written += int64(n)
+	}}
+	for s := range b.segments(0, b.size) {
+		scanner.feed(s)
+	}
+	scanner.end()
+
+	if err != nil {
+		return written, err
+	}
+	return written, writer.Flush()
+}
+
+// DeleteLineAware deletes the rune at the index idx of a PieceTable[rune],
+// deleting both runes of a CRLF if idx is either of them, so a line break is
+// deleted at once with backspace (deleting before the cursor) or the delete
+// key (deleting at it). Returns the index where the deletion starts, which is
+// where the cursor should be placed.
+//
+// Both runes of a CRLF are deleted as a single deletion, whatever the
+// coalescing policy, so undoing never leaves half of it. The deletion may
+// still be merged with the ones around it as the policy decides, like the
+// deletion of any other rune.
+func DeleteLineAware(b *PieceTable[rune], idx int) (int, error) {
+	r, err := b.Get(idx)
+	if err != nil {
+		return idx, err
+	}
+
+	// The rune of the CRLF deleted after idx, which is merged into the
+	// deletion of the one at idx.
+	second := idx
+	switch r {
+	case '\r':
+		if next, err := b.Get(idx + 1); err != nil || next != '\n' {
+			return idx, b.Delete(idx)
+		}
+	case '\n':
+		if prev, err := b.Get(idx - 1); err != nil || prev != '\r' {
+			return idx, b.Delete(idx)
+		}
+		second = idx - 1
+	default:
+		return idx, b.Delete(idx)
+	}
+
+	if err := b.Delete(idx); err != nil {
+		return idx, err
+	}
+	b.mergeNext = true
+	defer func() { b.mergeNext = false }()
+	return second, b.Delete(second)
+}
@@ -0,0 +1,256 @@
+package gopiecetable
+
+import (
+	"iter"
+	"sort"
+	"strings"
+)
+
+// Indexes the line breaks of a PieceTable[rune]. As the buffers are
+// append-only, the breaks in each buffer are found only once, and the breaks
+// before each piece are counted again only when the pieces change.
+type lineIndex struct {
+	// The epoch of the buffers indexed.
+	epoch int
+	// For each buffer, the positions of the breaks in the part scanned.
+	breaks [][]int
+	// For each buffer, how much was scanned.
+	scanned []int
+	// The revision the pieces were counted at.
+	revision uint64
+	// For each piece, the amount of breaks before it, followed by the total.
+	before []int
+	// For each piece, the index where it starts.
+	starts []int
+}
+
+// Returns the line index of the piece table, up to date.
+func linesOf(b *PieceTable[rune]) *lineIndex {
+	if b.lines == nil || b.lines.epoch != b.epoch {
+		b.lines = &lineIndex{epoch: b.epoch, revision: b.Revision()}
+	} else if b.lines.revision == b.Revision() && b.lines.before != nil {
+		return b.lines
+	}
+
+	l := b.lines
+	l.revision = b.Revision()
+	l.before = l.before[:0]
+	l.starts = l.starts[:0]
+	total, idx := 0, 0
+	for _, p := range b.pieces {
+		l.before = append(l.before, total)
+		l.starts = append(l.starts, idx)
+		total += l.breaksIn(b, p, 0, p.length)
+		idx += p.length
+	}
+	l.before = append(l.before, total)
+	return l
+}
+
+// Scans the buffer buf up to its current size.
+func (l *lineIndex) scan(b *PieceTable[rune], buf int) {
+	for len(l.breaks) < len(b.buffers) {
+		l.breaks = append(l.breaks, nil)
+		l.scanned = append(l.scanned, 0)
+	}
+	content := b.buffers[buf].content
+	for i := l.scanned[buf]; i < len(content); i++ {
+		if content[i] == '\n' {
+			l.breaks[buf] = append(l.breaks[buf], i)
+		}
+	}
+	l.scanned[buf] = len(content)
+}
+
+// Calls f with the position in the buffer of each part of [from, to) of the
+// piece, which may span buffers.
+func (l *lineIndex) parts(
+	b *PieceTable[rune],
+	p piece,
+	from int,
+	to int,
+	f func(buf, start, end int) bool,
+) {
+	if from == to {
+		return
+	}
+	buf, start := b.indexByPiece(p, from)
+	for n := to - from; n > 0; buf++ {
+		end := min(b.buffers[buf].size(), start+n)
+		if !f(buf, start, end) {
+			return
+		}
+		n -= end - start
+		start = 0
+	}
+}
+
+// Returns the amount of breaks in [from, to) of the piece.
+func (l *lineIndex) breaksIn(b *PieceTable[rune], p piece, from, to int) int {
+	n := 0
+	l.parts(b, p, from, to, func(buf, start, end int) bool {
+		if l.scanned == nil || buf >= len(l.scanned) || l.scanned[buf] < end {
+			l.scan(b, buf)
+		}
+		n += sort.SearchInts(l.breaks[buf], end) -
+			sort.SearchInts(l.breaks[buf], start)
+		return true
+	})
+	return n
+}
+
+// Returns the displacement in the piece of its k-th break, counting from one.
+func (l *lineIndex) nthBreak(b *PieceTable[rune], p piece, k int) int {
+	disp, found := 0, -1
+	l.parts(b, p, 0, p.length, func(buf, start, end int) bool {
+		breaks := l.breaks[buf]
+		first := sort.SearchInts(breaks, start)
+		n := sort.SearchInts(breaks, end) - first
+		if k <= n {
+			found = disp + breaks[first+k-1] - start
+			return false
+		}
+		k -= n
+		disp += end - start
+		return true
+	})
+	return found
+}
+
+// Returns the amount of line breaks.
+func (l *lineIndex) count() int {
+	return l.before[len(l.before)-1]
+}
+
+// Returns the index where the line starts, which must exist.
+func (l *lineIndex) start(b *PieceTable[rune], line int) int {
+	if line == 0 {
+		return 0
+	}
+	// The piece with the break ending the previous line.
+	pidx := sort.SearchInts(l.before, line) - 1
+	p := b.pieces[pidx]
+	return l.starts[pidx] + l.nthBreak(b, p, line-l.before[pidx]) + 1
+}
+
+// Returns the item at idx, which must be in bounds, finding the piece with the
+// index.
+func (l *lineIndex) at(b *PieceTable[rune], idx int) rune {
+	pidx := sort.SearchInts(l.starts, idx+1) - 1
+	buf, disp := b.indexByPiece(b.pieces[pidx], idx-l.starts[pidx])
+	return b.buffers[buf].content[disp]
+}
+
+// Returns the segments of the items in [start, end), finding the first piece
+// with the index.
+func (l *lineIndex) segments(
+	b *PieceTable[rune],
+	start int,
+	end int,
+) iter.Seq[[]rune] {
+	if start == end {
+		return func(yield func([]rune) bool) {}
+	}
+	// The last piece starting before or at start.
+	pidx := sort.SearchInts(l.starts, start+1) - 1
+	return b.segmentsAt(pidx, start-l.starts[pidx], end-start)
+}
+
+// LineCount returns the amount of lines of a PieceTable[rune], i.e., one more
+// than the amount of LF line breaks. A CR only breaks lines as part of a CRLF,
+// so content with CR line endings (see DetectLineEnding) is a single line.
+func LineCount(b *PieceTable[rune]) int {
+	return linesOf(b).count() + 1
+}
+
+// Returns the ranges of the lines in [fromLine, toLine) that exist, with or
+// without the terminators.
+func lineRanges(
+	b *PieceTable[rune],
+	fromLine int,
+	toLine int,
+	terminators bool,
+) iter.Seq2[int, [2]int] {
+	return func(yield func(int, [2]int) bool) {
+		l := linesOf(b)
+		fromLine = max(fromLine, 0)
+		toLine = min(toLine, l.count()+1)
+		if fromLine >= toLine {
+			return
+		}
+
+		start := l.start(b, fromLine)
+		for line := fromLine; line < toLine; line++ {
+			end, next := b.size, b.size
+			if line < l.count() {
+				next = l.start(b, line+1)
+				end = next
+				if !terminators {
+					end--
+					// CRLF is a single line break.
+					if end > start && l.at(b, end-1) == '\r' {
+						end--
+					}
+				}
+			}
+			if !yield(line, [2]int{start, end}) {
+				return
+			}
+			start = next
+		}
+	}
+}
+
+// Lines iterates over the lines in [fromLine, toLine) of a PieceTable[rune],
+// counting from zero, yielding their numbers and text, with the terminators if
+// terminators is true. Lines end with LF or CRLF, but not with a lone CR, see
+// LineCount. Lines past the last are ignored. Only the pieces with the lines
+// are read, found with an index of the line breaks that's updated after edits.
+func Lines(
+	b *PieceTable[rune],
+	fromLine int,
+	toLine int,
+	terminators bool,
+) iter.Seq2[int, string] {
+	return func(yield func(int, string) bool) {
+		l := linesOf(b)
+		var builder strings.Builder
+		for line, r := range lineRanges(b, fromLine, toLine, terminators) {
+			builder.Reset()
+			builder.Grow(r[1] - r[0])
+			for s := range l.segments(b, r[0], r[1]) {
+				for _, c := range s {
+					builder.WriteRune(c)
+				}
+			}
+			if !yield(line, builder.String()) {
+				return
+			}
+		}
+	}
+}
+
+// LineSegments is like Lines, but yields the lines as the subslices of the
+// buffers holding them, without copying. The subslices must not be modified,
+// and the slice holding them is reused, so both are only valid until the next
+// iteration and while the piece table is not edited.
+func LineSegments(
+	b *PieceTable[rune],
+	fromLine int,
+	toLine int,
+	terminators bool,
+) iter.Seq2[int, [][]rune] {
+	return func(yield func(int, [][]rune) bool) {
+		l := linesOf(b)
+		var segments [][]rune
+		for line, r := range lineRanges(b, fromLine, toLine, terminators) {
+			segments = segments[:0]
+			for s := range l.segments(b, r[0], r[1]) {
+				segments = append(segments, s)
+			}
+			if !yield(line, segments) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package gopiecetable
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Returned when replaying a call yields a different result than recorded.
+var ErrorReplayDiverged = errors.New("replay diverged")
+
+// Returned when an operation log can't be decoded.
+var ErrorMalformedLog = errors.New("malformed log")
+
+// CallKind tells which method a recorded call is.
+type CallKind int
+
+const (
+	CallInsert CallKind = iota
+	CallDelete
+	CallUndo
+	CallRedo
+	CallGroup
+	CallTrim
+)
+
+var callNames = [...]string{
+	"insert",
+	"delete",
+	"undo",
+	"redo",
+	"group",
+	"trim",
+}
+
+func (k CallKind) String() string {
+	if k < 0 || int(k) >= len(callNames) {
+		return fmt.Sprintf("CallKind(%d)", int(k))
+	}
+	return callNames[k]
+}
+
+func (k CallKind) MarshalText() ([]byte, error) {
+	if k < 0 || int(k) >= len(callNames) {
+		return nil, fmt.Errorf("unknown call kind %d", int(k))
+	}
+	return []byte(callNames[k]), nil
+}
+
+func (k *CallKind) UnmarshalText(text []byte) error {
+	for i, name := range callNames {
+		if string(text) == name {
+			*k = CallKind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown call kind %q", text)
+}
+
+// Call is a recorded call to Insert, Delete, Undo, Redo or TrimHistory, with
+// its arguments and results. Calls to UndoEdit and RedoEdit are recorded as
+// Undo and Redo, and edits made at once, e.g., by ApplyTextEdits, as a group of
+// replacements.
+type Call[Content any] struct {
+	Kind CallKind `json:"call"`
+	// The index given to Insert and Delete, or the amount of edits given to
+	// TrimHistory.
+	Index int `json:"idx,omitempty"`
+	// The item given to Insert.
+	Item Content `json:"item,omitempty"`
+	// The index returned by Undo and Redo.
+	Result int `json:"res,omitempty"`
+	// The message of the error returned, if any.
+	Err string `json:"err,omitempty"`
+	// The replacements of a group.
+	Group []Replacement[Content] `json:"group,omitempty"`
+	// Wether the insertion or deletion was merged into the last edit, as
+	// decided by the coalescing policy.
+	Merged bool `json:"merged,omitempty"`
+	// The amount of edits discarded by WithMaxAge after the call.
+	Aged int `json:"aged,omitempty"`
+}
+
+// Replacement replaces the items in [Start, End) with Items, as part of a
+// recorded group.
+type Replacement[Content any] struct {
+	Start int       `json:"start"`
+	End   int       `json:"end"`
+	Items []Content `json:"items,omitempty"`
+}
+
+// Recorded returns the calls recorded since the piece table was created with
+// WithRecording. Other methods that edit the piece table, such as GoTo and
+// ApplyTextEdits, are recorded as the calls they're made of.
+func (b *PieceTable[Content]) Recorded() []Call[Content] {
+	return b.calls[:len(b.calls):len(b.calls)]
+}
+
+// Records and journals the call.
+func (b *PieceTable[Content]) record(c Call[Content], err error) {
+	if err != nil {
+		c.Err = err.Error()
+	}
+	c.Aged = b.aged
+	b.aged = 0
+	if b.options.recording {
+		b.calls = append(b.calls, c)
+	}
+	// Failed calls change nothing, so there's nothing to recover.
+	if b.options.journal != nil && err == nil {
+		b.journal(c)
+	}
+}
+
+// Replay makes the calls on the piece table, which should have the content and
+// options the recorded one had when created. Returns ErrorReplayDiverged as
+// soon as a call returns something other than recorded.
+//
+// The coalescing policy and the time don't matter: insertions and deletions are
+// merged into the last edit as recorded, and the edits discarded by WithMaxAge
+// are discarded after the same calls.
+func (b *PieceTable[Content]) Replay(calls []Call[Content]) error {
+	defer func() { b.replaying = nil }()
+	for i, c := range calls {
+		b.replaying = &c
+		var result int
+		var err error
+		switch c.Kind {
+		case CallInsert:
+			err = b.Insert(c.Index, c.Item)
+		case CallDelete:
+			err = b.Delete(c.Index)
+		case CallUndo:
+			result, err = b.Undo()
+		case CallRedo:
+			result, err = b.Redo()
+		case CallGroup:
+			reps := make([]replacement[Content], 0, len(c.Group))
+			for _, r := range c.Group {
+				if r.Start < 0 || r.End < r.Start || r.End > b.size ||
+					(len(reps) > 0 && r.Start < reps[len(reps)-1].end) {
+					err = ErrorOutOfBounds
+					break
+				}
+				reps = append(reps, replacement[Content]{
+					start:   r.Start,
+					end:     r.End,
+					content: r.Items,
+				})
+			}
+			if err == nil {
+				b.replaceGrouped(reps)
+			}
+		case CallTrim:
+			b.TrimHistory(c.Index)
+		default:
+			return fmt.Errorf("%w: call %v is %v", ErrorReplayDiverged, i, c.Kind)
+		}
+
+		var msg string
+		if err != nil {
+			msg = err.Error()
+			result = 0
+		}
+		if result != c.Result || msg != c.Err {
+			return fmt.Errorf(
+				"%w: call %v (%v) returned %v, %q instead of %v, %q",
+				ErrorReplayDiverged,
+				i,
+				c.Kind,
+				result,
+				msg,
+				c.Result,
+				c.Err,
+			)
+		}
+		if (c.Kind == CallInsert || c.Kind == CallDelete) &&
+			err == nil && b.merged != c.Merged {
+			return fmt.Errorf(
+				"%w: call %v (%v) could not be merged into the last edit",
+				ErrorReplayDiverged,
+				i,
+				c.Kind,
+			)
+		}
+		b.dropOldest(c.Aged)
+	}
+	return nil
+}
+
+// WriteLog writes the calls to w as JSON lines, one call per line.
+func WriteLog[Content any](w io.Writer, calls []Call[Content]) error {
+	encoder := json.NewEncoder(w)
+	for _, c := range calls {
+		if err := encoder.Encode(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadLog reads calls written by WriteLog from r, ignoring empty lines.
+func ReadLog[Content any](r io.Reader) ([]Call[Content], error) {
+	calls, _, err := readLog[Content](r, false)
+	return calls, err
+}
+
+// Reads a log, returning the calls and the length of the lines read. If torn
+// is true, the last line is ignored if it's not terminated, as it was only
+// partially written, and not included in the length.
+func readLog[Content any](
+	r io.Reader,
+	torn bool,
+) ([]Call[Content], int64, error) {
+	var calls []Call[Content]
+	var length int64
+	reader := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return calls, length, err
+		}
+		if torn && err == io.EOF {
+			return calls, length, nil
+		}
+		length += int64(len(line))
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var c Call[Content]
+			if jsonErr := json.Unmarshal(line, &c); jsonErr != nil {
+				return calls, length, fmt.Errorf(
+					"%w: line %v: %v",
+					ErrorMalformedLog,
+					n,
+					jsonErr,
+				)
+			}
+			calls = append(calls, c)
+		}
+
+		if err == io.EOF {
+			return calls, length, nil
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package gopiecetable
+
+import (
+	"io"
+	"time"
+)
+
+// Option configures a piece table. Pass them to New, FromSlice or FromString.
+type Option func(*options)
+
+// The configuration of a piece table. The zero value means no limits.
+type options struct {
+	// Maximum amount of edits in the undo/redo list.
+	maxEdits int
+	// Maximum amount of items inserted and deleted by the edits in the
+	// undo/redo list.
+	maxEditedItems int
+	// Maximum age of the edits in the undo/redo list.
+	maxAge time.Duration
+	// Amount of items of the discarded edits after which the buffers are
+	// compacted.
+	autoCompact int
+	// Size of the backing buffers in items. Has precedence over bufferBytes.
+	bufferItems int
+	// Size of the backing buffers in bytes.
+	bufferBytes int
+	// Wether the public calls are recorded.
+	recording bool
+	// Where the edits are journaled, if anywhere.
+	journal io.Writer
+	// Minimum time between syncs of the journal.
+	journalSync time.Duration
+}
+
+// WithMaxEdits limits the undo/redo list to n edits, discarding the oldest
+// ones. Zero means no limit.
+func WithMaxEdits(n int) Option {
+	return func(o *options) {
+		o.maxEdits = max(n, 0)
+	}
+}
+
+// WithMaxEditedItems limits the undo/redo list to edits that, summed up,
+// inserted or deleted at most n items, discarding the oldest ones. Zero means
+// no limit.
+func WithMaxEditedItems(n int) Option {
+	return func(o *options) {
+		o.maxEditedItems = max(n, 0)
+	}
+}
+
+// WithMaxAge discards edits that were last changed more than d ago. The age is
+// checked on every edit, so old edits are kept while the piece table is not
+// changed. Zero means no limit.
+func WithMaxAge(d time.Duration) Option {
+	return func(o *options) {
+		o.maxAge = max(d, 0)
+	}
+}
+
+// WithAutoCompact makes the piece table call Compact by itself once the edits
+// discarded by the limits, summed up, inserted or deleted at least n items.
+// Zero means never.
+func WithAutoCompact(n int) Option {
+	return func(o *options) {
+		o.autoCompact = max(n, 0)
+	}
+}
+
+// WithBufferSize makes the backing buffers hold n items each. Bigger buffers
+// mean less allocations but more memory wasted by tables that are barely
+// edited. Values below a minimum of 16 items are rounded up.
+func WithBufferSize(n int) Option {
+	return func(o *options) {
+		o.bufferItems = max(n, minBufferSize)
+	}
+}
+
+// WithBufferBytes makes the backing buffers take about n bytes each, holding
+// at least 16 items. By default, buffers take the size of a memory page.
+func WithBufferBytes(n int) Option {
+	return func(o *options) {
+		o.bufferBytes = max(n, 0)
+	}
+}
+
+// WithRecording makes the piece table record every call to Insert, Delete,
+// Undo, Redo and TrimHistory, see Recorded.
+func WithRecording() Option {
+	return func(o *options) {
+		o.recording = true
+	}
+}
+
+// WithJournal makes the piece table write every edit, undo and redo to w as
+// soon as it's made, in the format of WriteLog, so Recover can rebuild it after
+// a crash. If w has a Sync method, like *os.File, it's called after writing if
+// at least sync passed since the last time, so zero means after every edit.
+func WithJournal(w io.Writer, sync time.Duration) Option {
+	return func(o *options) {
+		o.journal = w
+		o.journalSync = max(sync, 0)
+	}
+}
+
+// Applies the options to the piece table.
+func (b *PieceTable[Content]) configure(opts []Option) {
+	for _, opt := range opts {
+		opt(&b.options)
+	}
+}
@@ -0,0 +1,476 @@
+// Package ot implements collaborative editing on top of piece tables with
+// operational transformation.
+//
+// An operation walks the whole content, retaining, inserting and deleting
+// items. Concurrent operations are transformed against each other so they can
+// be applied in any order, and a server keeps the authoritative log of
+// operations every client transforms its own operations against.
+package ot
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/gboncoffee/gopiecetable"
+)
+
+// Returned when an operation does not apply to some content, or when two
+// operations can't be transformed or composed because of their lengths.
+var ErrorLengthMismatch = errors.New("length mismatch")
+
+// Returned when the server receives an operation based on a revision it
+// doesn't have.
+var ErrorNoSuchRevision = errors.New("no such revision")
+
+// Kind tells what a component of an operation does.
+type Kind int
+
+const (
+	Retain Kind = iota
+	Insert
+	Delete
+)
+
+// Component is a step of an operation: retaining or deleting Count items, or
+// inserting Items.
+type Component[Content any] struct {
+	Kind  Kind
+	Count int
+	Items []Content
+}
+
+// Returns the amount of items the component walks through.
+func (c Component[Content]) length() int {
+	if c.Kind == Insert {
+		return len(c.Items)
+	}
+	return c.Count
+}
+
+// Returns the component without its first n items.
+func (c Component[Content]) skip(n int) Component[Content] {
+	if c.Kind == Insert {
+		c.Items = c.Items[n:]
+	} else {
+		c.Count -= n
+	}
+	return c
+}
+
+// Operation is a sequence of components walking through the whole content it
+// applies to. The zero value is the empty operation, and operations are built
+// with Retain, Insert and Delete, e.g.:
+//
+//	var op Operation[rune]
+//	op.Retain(5).Insert([]rune(", World")...).Delete(6)
+type Operation[Content any] struct {
+	Components []Component[Content]
+}
+
+// Retain adds a component retaining n items.
+func (o *Operation[Content]) Retain(n int) *Operation[Content] {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o.Components) - 1; last >= 0 &&
+		o.Components[last].Kind == Retain {
+		o.Components[last].Count += n
+		return o
+	}
+	o.Components = append(o.Components, Component[Content]{
+		Kind:  Retain,
+		Count: n,
+	})
+	return o
+}
+
+// Insert adds a component inserting the items.
+func (o *Operation[Content]) Insert(items ...Content) *Operation[Content] {
+	if len(items) == 0 {
+		return o
+	}
+	last := len(o.Components) - 1
+	// Insertions always go before deletions next to them, so operations that
+	// do the same look the same.
+	if last >= 0 && o.Components[last].Kind == Delete {
+		if last > 0 && o.Components[last-1].Kind == Insert {
+			c := &o.Components[last-1]
+			c.Items = append(c.Items, items...)
+			return o
+		}
+		o.Components = slices.Insert(o.Components, last, Component[Content]{
+			Kind:  Insert,
+			Items: slices.Clone(items),
+		})
+		return o
+	}
+	if last >= 0 && o.Components[last].Kind == Insert {
+		c := &o.Components[last]
+		c.Items = append(c.Items, items...)
+		return o
+	}
+	o.Components = append(o.Components, Component[Content]{
+		Kind:  Insert,
+		Items: slices.Clone(items),
+	})
+	return o
+}
+
+// Delete adds a component deleting n items.
+func (o *Operation[Content]) Delete(n int) *Operation[Content] {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o.Components) - 1; last >= 0 &&
+		o.Components[last].Kind == Delete {
+		o.Components[last].Count += n
+		return o
+	}
+	o.Components = append(o.Components, Component[Content]{
+		Kind:  Delete,
+		Count: n,
+	})
+	return o
+}
+
+// BaseLength returns the size of the content the operation applies to.
+func (o Operation[Content]) BaseLength() int {
+	n := 0
+	for _, c := range o.Components {
+		if c.Kind != Insert {
+			n += c.Count
+		}
+	}
+	return n
+}
+
+// TargetLength returns the size of the content after applying the operation.
+func (o Operation[Content]) TargetLength() int {
+	n := 0
+	for _, c := range o.Components {
+		if c.Kind != Delete {
+			n += c.length()
+		}
+	}
+	return n
+}
+
+// Apply applies the operation to the piece table, with one edit for each
+// component inserting or deleting. Returns ErrorLengthMismatch without
+// changing anything if the operation does not apply to the piece table.
+func (o Operation[Content]) Apply(b *gopiecetable.PieceTable[Content]) error {
+	if o.BaseLength() != b.Size() {
+		return fmt.Errorf(
+			"%w: operation applies to %v items, piece table has %v",
+			ErrorLengthMismatch,
+			o.BaseLength(),
+			b.Size(),
+		)
+	}
+
+	idx := 0
+	for _, c := range o.Components {
+		switch c.Kind {
+		case Retain:
+			idx += c.Count
+		case Insert:
+			for _, item := range c.Items {
+				b.Insert(idx, item)
+				idx++
+			}
+		case Delete:
+			// Backwards, so it's a single edit.
+			for i := idx + c.Count - 1; i >= idx; i-- {
+				b.Delete(i)
+			}
+		}
+	}
+	return nil
+}
+
+// Reads the components of an operation, possibly in parts.
+type reader[Content any] struct {
+	components []Component[Content]
+	current    Component[Content]
+	ok         bool
+}
+
+func newReader[Content any](o Operation[Content]) *reader[Content] {
+	r := &reader[Content]{components: o.Components}
+	r.next()
+	return r
+}
+
+// Moves to the next component, if any.
+func (r *reader[Content]) next() {
+	r.ok = len(r.components) > 0
+	if r.ok {
+		r.current = r.components[0]
+		r.components = r.components[1:]
+	}
+}
+
+// Consumes n items of the current component.
+func (r *reader[Content]) consume(n int) {
+	r.current = r.current.skip(n)
+	if r.current.length() == 0 {
+		r.next()
+	}
+}
+
+// Transform transforms the concurrent operations a and b, which apply to the
+// same content, returning a' and b' such that applying a and then b' yields the
+// same as applying b and then a'. When both insert at the same index, the
+// items of a go first. Returns ErrorLengthMismatch if they don't apply to the
+// same content.
+func Transform[Content any](
+	a, b Operation[Content],
+) (Operation[Content], Operation[Content], error) {
+	if a.BaseLength() != b.BaseLength() {
+		return Operation[Content]{}, Operation[Content]{}, fmt.Errorf(
+			"%w: operations apply to %v and %v items",
+			ErrorLengthMismatch,
+			a.BaseLength(),
+			b.BaseLength(),
+		)
+	}
+
+	var aPrime, bPrime Operation[Content]
+	ra, rb := newReader(a), newReader(b)
+	for ra.ok || rb.ok {
+		if ra.ok && ra.current.Kind == Insert {
+			aPrime.Insert(ra.current.Items...)
+			bPrime.Retain(len(ra.current.Items))
+			ra.next()
+			continue
+		}
+		if rb.ok && rb.current.Kind == Insert {
+			aPrime.Retain(len(rb.current.Items))
+			bPrime.Insert(rb.current.Items...)
+			rb.next()
+			continue
+		}
+
+		n := min(ra.current.Count, rb.current.Count)
+		switch {
+		case ra.current.Kind == Retain && rb.current.Kind == Retain:
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+		case ra.current.Kind == Delete && rb.current.Kind == Retain:
+			aPrime.Delete(n)
+		case ra.current.Kind == Retain && rb.current.Kind == Delete:
+			bPrime.Delete(n)
+		}
+		// When both delete, it's deleted already in both sides.
+		ra.consume(n)
+		rb.consume(n)
+	}
+
+	return aPrime, bPrime, nil
+}
+
+// Compose returns an operation that does the same as applying a and then b.
+// Returns ErrorLengthMismatch if b does not apply to the result of a.
+func Compose[Content any](a, b Operation[Content]) (Operation[Content], error) {
+	if a.TargetLength() != b.BaseLength() {
+		return Operation[Content]{}, fmt.Errorf(
+			"%w: operation results in %v items, next applies to %v",
+			ErrorLengthMismatch,
+			a.TargetLength(),
+			b.BaseLength(),
+		)
+	}
+
+	var composed Operation[Content]
+	ra, rb := newReader(a), newReader(b)
+	for ra.ok || rb.ok {
+		if ra.ok && ra.current.Kind == Delete {
+			composed.Delete(ra.current.Count)
+			ra.next()
+			continue
+		}
+		if rb.ok && rb.current.Kind == Insert {
+			composed.Insert(rb.current.Items...)
+			rb.next()
+			continue
+		}
+
+		n := min(ra.current.length(), rb.current.Count)
+		switch {
+		case ra.current.Kind == Retain && rb.current.Kind == Retain:
+			composed.Retain(n)
+		case ra.current.Kind == Retain && rb.current.Kind == Delete:
+			composed.Delete(n)
+		case ra.current.Kind == Insert && rb.current.Kind == Retain:
+			composed.Insert(ra.current.Items[:n]...)
+		}
+		// Items inserted by a and deleted by b are never there.
+		ra.consume(n)
+		rb.consume(n)
+	}
+
+	return composed, nil
+}
+
+// Submission is an operation sent by a client to the server, based on the
+// revision of the server the client had seen.
+type Submission[Content any] struct {
+	Revision  int
+	Operation Operation[Content]
+}
+
+// Server keeps the authoritative content and the log of operations applied to
+// it, one for each revision.
+type Server[Content any] struct {
+	table *gopiecetable.PieceTable[Content]
+	log   []Operation[Content]
+}
+
+// NewServer returns a server at the revision 0 with the content of the piece
+// table, which must only be edited through the server afterwards.
+func NewServer[Content any](
+	table *gopiecetable.PieceTable[Content],
+) *Server[Content] {
+	return &Server[Content]{table: table}
+}
+
+// Table returns the piece table of the server. It must not be edited directly.
+func (s *Server[Content]) Table() *gopiecetable.PieceTable[Content] {
+	return s.table
+}
+
+// Revision returns the current revision, i.e., the amount of operations
+// applied.
+func (s *Server[Content]) Revision() int {
+	return len(s.log)
+}
+
+// Log returns the operations applied after the revision rev, which must be
+// broadcasted to the clients in order.
+func (s *Server[Content]) Log(rev int) []Operation[Content] {
+	return s.log[rev:]
+}
+
+// Receive transforms an operation submitted by a client against the ones
+// applied since its revision and applies it, returning the transformed
+// operation, which is then the last one in the log.
+func (s *Server[Content]) Receive(sub Submission[Content]) (
+	Operation[Content],
+	error,
+) {
+	if sub.Revision < 0 || sub.Revision > len(s.log) {
+		return Operation[Content]{}, fmt.Errorf(
+			"%w: %v",
+			ErrorNoSuchRevision,
+			sub.Revision,
+		)
+	}
+
+	op := sub.Operation
+	for _, applied := range s.log[sub.Revision:] {
+		var err error
+		op, _, err = Transform(op, applied)
+		if err != nil {
+			return Operation[Content]{}, err
+		}
+	}
+	if err := op.Apply(s.table); err != nil {
+		return Operation[Content]{}, err
+	}
+
+	s.log = append(s.log, op)
+	return op, nil
+}
+
+// Client keeps a local copy of the content of a server, applying local
+// operations right away. At most one operation is sent to the server at a
+// time: local operations made while waiting for the server to acknowledge it
+// are composed and sent afterwards.
+type Client[Content any] struct {
+	table    *gopiecetable.PieceTable[Content]
+	revision int
+	// Sent and not acknowledged yet.
+	sent *Operation[Content]
+	// Not sent yet.
+	buffer *Operation[Content]
+}
+
+// NewClient returns a client whose piece table has the content of the server
+// at the revision rev. It must only be edited through the client afterwards.
+func NewClient[Content any](
+	table *gopiecetable.PieceTable[Content],
+	rev int,
+) *Client[Content] {
+	return &Client[Content]{table: table, revision: rev}
+}
+
+// Table returns the piece table of the client. It must not be edited directly.
+func (c *Client[Content]) Table() *gopiecetable.PieceTable[Content] {
+	return c.table
+}
+
+// Revision returns the last revision of the server the client has seen.
+func (c *Client[Content]) Revision() int {
+	return c.revision
+}
+
+// Edit applies a local operation. Returns the submission to send to the server
+// and true if it must be sent now.
+func (c *Client[Content]) Edit(op Operation[Content]) (
+	Submission[Content],
+	bool,
+	error,
+) {
+	if err := op.Apply(c.table); err != nil {
+		return Submission[Content]{}, false, err
+	}
+
+	switch {
+	case c.sent == nil:
+		c.sent = &op
+		return Submission[Content]{Revision: c.revision, Operation: op}, true, nil
+	case c.buffer == nil:
+		c.buffer = &op
+	default:
+		composed, err := Compose(*c.buffer, op)
+		if err != nil {
+			return Submission[Content]{}, false, err
+		}
+		c.buffer = &composed
+	}
+	return Submission[Content]{}, false, nil
+}
+
+// Ack tells the client the server applied its last submission. Returns the
+// next submission to send to the server and true if there's one.
+func (c *Client[Content]) Ack() (Submission[Content], bool) {
+	c.revision++
+	c.sent, c.buffer = c.buffer, nil
+	if c.sent == nil {
+		return Submission[Content]{}, false
+	}
+	return Submission[Content]{Revision: c.revision, Operation: *c.sent}, true
+}
+
+// Receive applies an operation of another client broadcasted by the server,
+// transforming it against the local operations the server hasn't applied yet.
+func (c *Client[Content]) Receive(op Operation[Content]) error {
+	for _, pending := range []**Operation[Content]{&c.sent, &c.buffer} {
+		if *pending == nil {
+			continue
+		}
+		transformed, remote, err := Transform(**pending, op)
+		if err != nil {
+			return err
+		}
+		*pending = &transformed
+		op = remote
+	}
+
+	if err := op.Apply(c.table); err != nil {
+		return err
+	}
+	c.revision++
+	return nil
+}
@@ -0,0 +1,265 @@
+package ot
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/gboncoffee/gopiecetable"
+)
+
+// Returns a random operation applying to size items.
+func helperRandomOperation(rng *rand.Rand, size int) Operation[rune] {
+	var op Operation[rune]
+	for left := size; left > 0 || rng.IntN(3) == 0; {
+		n := rng.IntN(left + 1)
+		switch rng.IntN(3) {
+		case 0:
+			op.Retain(n)
+			left -= n
+		case 1:
+			op.Delete(n)
+			left -= n
+		default:
+			for range rng.IntN(4) + 1 {
+				op.Insert('a' + rune(rng.IntN(26)))
+			}
+		}
+		if left == 0 && rng.IntN(2) == 0 {
+			break
+		}
+	}
+	return op
+}
+
+func helperApply(t *testing.T, content string, ops ...Operation[rune]) string {
+	t.Helper()
+	b := gopiecetable.FromString(content)
+	for _, op := range ops {
+		if err := op.Apply(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return gopiecetable.String(b)
+}
+
+func TestBuilding(t *testing.T) {
+	var op Operation[rune]
+	op.Retain(2).Retain(3).Delete(1).Insert('a').Delete(1).Insert('b')
+	expected := []Component[rune]{
+		{Kind: Retain, Count: 5},
+		{Kind: Insert, Items: []rune("ab")},
+		{Kind: Delete, Count: 2},
+	}
+	if len(op.Components) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, op.Components)
+	}
+	for i, c := range op.Components {
+		e := expected[i]
+		if c.Kind != e.Kind || c.Count != e.Count ||
+			string(c.Items) != string(e.Items) {
+			t.Fatalf("expected %v, got %v", expected, op.Components)
+		}
+	}
+	if op.BaseLength() != 7 || op.TargetLength() != 7 {
+		t.Fatalf(
+			"expected lengths 7 and 7, got %v and %v",
+			op.BaseLength(),
+			op.TargetLength(),
+		)
+	}
+}
+
+func TestApply(t *testing.T) {
+	var op Operation[rune]
+	op.Retain(5).Insert([]rune(",")...).Retain(1).Delete(5).Insert('G', 'o')
+	if s := helperApply(t, "Hello World", op); s != "Hello, Go" {
+		t.Fatalf("expected %q, got %q", "Hello, Go", s)
+	}
+
+	b := gopiecetable.FromString("Hello")
+	if err := op.Apply(b); !errors.Is(err, ErrorLengthMismatch) {
+		t.Fatalf("expected ErrorLengthMismatch, got %v", err)
+	}
+	if s := gopiecetable.String(b); s != "Hello" {
+		t.Fatalf("failed operation changed the content to %q", s)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	var a, b Operation[rune]
+	a.Retain(1).Insert('x').Retain(2)
+	b.Retain(1).Insert('y').Delete(1).Retain(1)
+	aPrime, bPrime, err := Transform(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab := helperApply(t, "abc", a, bPrime)
+	ba := helperApply(t, "abc", b, aPrime)
+	if ab != "axyc" || ba != "axyc" {
+		t.Fatalf("expected %q, got %q and %q", "axyc", ab, ba)
+	}
+
+	var c Operation[rune]
+	c.Retain(2)
+	if _, _, err := Transform(a, c); !errors.Is(err, ErrorLengthMismatch) {
+		t.Fatalf("expected ErrorLengthMismatch, got %v", err)
+	}
+}
+
+func TestRandomTransform(t *testing.T) {
+	rng := rand.New(rand.NewPCG(420, 69))
+	content := "Hello World"
+	for range 1000 {
+		a := helperRandomOperation(rng, len(content))
+		b := helperRandomOperation(rng, len(content))
+		aPrime, bPrime, err := Transform(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ab := helperApply(t, content, a, bPrime)
+		ba := helperApply(t, content, b, aPrime)
+		if ab != ba {
+			t.Fatalf("transformed operations yield %q and %q", ab, ba)
+		}
+	}
+}
+
+func TestRandomCompose(t *testing.T) {
+	rng := rand.New(rand.NewPCG(420, 69))
+	content := "Hello World"
+	for range 1000 {
+		a := helperRandomOperation(rng, len(content))
+		b := helperRandomOperation(rng, a.TargetLength())
+		composed, err := Compose(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := helperApply(t, content, a, b)
+		if s := helperApply(t, content, composed); s != expected {
+			t.Fatalf("expected %q, got %q", expected, s)
+		}
+	}
+
+	var a, b Operation[rune]
+	a.Retain(2)
+	b.Retain(3)
+	if _, err := Compose(a, b); !errors.Is(err, ErrorLengthMismatch) {
+		t.Fatalf("expected ErrorLengthMismatch, got %v", err)
+	}
+}
+
+// Stands for the server and the connections of the clients, delivering the
+// submissions and the log in order but at random times.
+type helperServer struct {
+	server  *Server[rune]
+	authors []int // Which client submitted each operation in the log.
+	clients []*Client[rune]
+	// The submissions each client sent that the server didn't receive yet.
+	outgoing [][]Submission[rune]
+	// How much of the log each client has received.
+	received []int
+}
+
+func helperNewServer(content string, clients int) *helperServer {
+	s := &helperServer{
+		server:   NewServer(gopiecetable.FromString(content)),
+		outgoing: make([][]Submission[rune], clients),
+		received: make([]int, clients),
+	}
+	for range clients {
+		s.clients = append(
+			s.clients,
+			NewClient(gopiecetable.FromString(content), 0),
+		)
+	}
+	return s
+}
+
+func (s *helperServer) edit(t *testing.T, i int, op Operation[rune]) {
+	t.Helper()
+	sub, send, err := s.clients[i].Edit(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if send {
+		s.outgoing[i] = append(s.outgoing[i], sub)
+	}
+}
+
+func (s *helperServer) submit(t *testing.T, i int) {
+	t.Helper()
+	if len(s.outgoing[i]) == 0 {
+		return
+	}
+	if _, err := s.server.Receive(s.outgoing[i][0]); err != nil {
+		t.Fatal(err)
+	}
+	s.outgoing[i] = s.outgoing[i][1:]
+	s.authors = append(s.authors, i)
+}
+
+func (s *helperServer) broadcast(t *testing.T, i int) {
+	t.Helper()
+	log := s.server.Log(s.received[i])
+	if len(log) == 0 {
+		return
+	}
+	if s.authors[s.received[i]] == i {
+		if sub, send := s.clients[i].Ack(); send {
+			s.outgoing[i] = append(s.outgoing[i], sub)
+		}
+	} else if err := s.clients[i].Receive(log[0]); err != nil {
+		t.Fatal(err)
+	}
+	s.received[i]++
+}
+
+func (s *helperServer) idle() bool {
+	for i := range s.clients {
+		if len(s.outgoing[i]) > 0 || s.received[i] < s.server.Revision() {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRandomClients(t *testing.T) {
+	rng := rand.New(rand.NewPCG(420, 69))
+	s := helperNewServer("Hello World", 4)
+
+	for range 3000 {
+		i := rng.IntN(len(s.clients))
+		switch rng.IntN(3) {
+		case 0:
+			size := s.clients[i].Table().Size()
+			s.edit(t, i, helperRandomOperation(rng, size))
+		case 1:
+			s.submit(t, i)
+		default:
+			s.broadcast(t, i)
+		}
+	}
+
+	for !s.idle() {
+		for i := range s.clients {
+			s.submit(t, i)
+			s.broadcast(t, i)
+		}
+	}
+
+	expected := gopiecetable.String(s.server.Table())
+	for i, c := range s.clients {
+		if c.Revision() != s.server.Revision() {
+			t.Fatalf(
+				"client %v is at revision %v, server at %v",
+				i,
+				c.Revision(),
+				s.server.Revision(),
+			)
+		}
+		if str := gopiecetable.String(c.Table()); str != expected {
+			t.Fatalf("client %v has %q, server has %q", i, str, expected)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package gopiecetable
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Returned when edits to apply at once overlap.
+var ErrorOverlappingEdits = errors.New("overlapping edits")
+
+// Returned when a patch does not apply to the content of the piece table.
+var ErrorConflict = errors.New("patch does not apply")
+
+// Returned when a unified diff can't be parsed.
+var ErrorMalformedPatch = errors.New("malformed patch")
+
+// TextEdit replaces the runes in [Start, End) with NewText, like the text edits
+// of the Language Server Protocol, but indexed by runes.
+type TextEdit struct {
+	Start   int
+	End     int
+	NewText string
+}
+
+// ApplyTextEdits applies the edits to a PieceTable[rune] as a single edit, so
+// they're undone and redone at once. The edits may be given in any order, but
+// must not overlap, except for insertions (Start == End) at the same index,
+// which are applied in the given order. Returns ErrorOutOfBounds or
+// ErrorOverlappingEdits without changing anything if the edits are invalid.
+func ApplyTextEdits(b *PieceTable[rune], edits []TextEdit) error {
+	sorted := slices.Clone(edits)
+	slices.SortStableFunc(sorted, func(x, y TextEdit) int {
+		if x.Start != y.Start {
+			return x.Start - y.Start
+		}
+		return x.End - y.End
+	})
+
+	reps := make([]replacement[rune], 0, len(sorted))
+	for i, e := range sorted {
+		if e.Start < 0 || e.End < e.Start || e.End > b.Size() {
+			return fmt.Errorf(
+				"%w: edit [%v, %v)",
+				ErrorOutOfBounds,
+				e.Start,
+				e.End,
+			)
+		}
+		if i > 0 && e.Start < sorted[i-1].End {
+			return fmt.Errorf(
+				"%w: [%v, %v) and [%v, %v)",
+				ErrorOverlappingEdits,
+				sorted[i-1].Start,
+				sorted[i-1].End,
+				e.Start,
+				e.End,
+			)
+		}
+
+		// Insertions at the same index are applied as one, so the first
+		// goes first.
+		if i > 0 && e.Start == e.End && sorted[i-1].End == e.Start {
+			last := &reps[len(reps)-1]
+			last.content = append(last.content, []rune(e.NewText)...)
+			continue
+		}
+		reps = append(reps, replacement[rune]{
+			start:   e.Start,
+			end:     e.End,
+			content: []rune(e.NewText),
+		})
+	}
+
+	b.replaceGrouped(reps)
+	return nil
+}
+
+// ApplyUnifiedDiff applies a patch in the unified diff format, like the ones
+// made by UnifiedDiff or diff -u, to a PieceTable[rune] as a single edit, so
+// all hunks are undone and redone at once. The context and removed lines of
+// every hunk must match the content exactly. Returns ErrorMalformedPatch or
+// ErrorConflict without changing anything if the patch does not apply.
+func ApplyUnifiedDiff(b *PieceTable[rune], patch string) error {
+	hunks, err := parseUnifiedDiff(patch)
+	if err != nil {
+		return err
+	}
+
+	content := Content(b)
+	lines := splitLines(content)
+	// Where each line starts, plus the end of the content.
+	starts := make([]int, 0, len(lines)+1)
+	pos := 0
+	for _, line := range lines {
+		starts = append(starts, pos)
+		pos += len([]rune(line))
+	}
+	starts = append(starts, pos)
+
+	reps := make([]replacement[rune], 0, len(hunks))
+	for i, h := range hunks {
+		// Empty ranges refer to the line before them.
+		from := h.from - 1
+		if len(h.old) == 0 {
+			from = h.from
+		}
+		if from < 0 || from+len(h.old) > len(lines) {
+			return fmt.Errorf(
+				"%w: hunk %v is out of the content",
+				ErrorConflict,
+				i+1,
+			)
+		}
+		if i > 0 && starts[from] < reps[len(reps)-1].end {
+			return fmt.Errorf(
+				"%w: hunk %v overlaps the previous one",
+				ErrorConflict,
+				i+1,
+			)
+		}
+
+		for j, line := range h.old {
+			if lines[from+j] != line {
+				return fmt.Errorf(
+					"%w: line %v does not match hunk %v",
+					ErrorConflict,
+					from+j+1,
+					i+1,
+				)
+			}
+		}
+
+		reps = append(reps, replacement[rune]{
+			start:   starts[from],
+			end:     starts[from+len(h.old)],
+			content: []rune(strings.Join(h.new, "")),
+		})
+	}
+
+	b.replaceGrouped(reps)
+	return nil
+}
+
+// A hunk of a unified diff.
+type unifiedHunk struct {
+	from int      // The first line of the old range, as in the header.
+	old  []string // The context and removed lines, with terminators.
+	new  []string // The context and added lines, with terminators.
+}
+
+// Parses the hunks of a unified diff, ignoring everything outside them, like
+// the headers of the files. Each hunk ends after the amount of lines given in
+// its header.
+func parseUnifiedDiff(patch string) ([]unifiedHunk, error) {
+	var hunks []unifiedHunk
+	// Which of old and new got the last line, for "\ No newline".
+	var last *[]string
+	// The lines of the current hunk still to be read.
+	oldLeft, newLeft := 0, 0
+	lines := strings.SplitAfter(patch, "\n")
+	// The last line has no terminator. In context lines it's on both sides.
+	noNewline := func() {
+		h := &hunks[len(hunks)-1]
+		if last == nil {
+			trimLastTerminator(h.old)
+			trimLastTerminator(h.new)
+		} else {
+			trimLastTerminator(*last)
+		}
+	}
+
+	for n, line := range lines {
+		malformed := func(why string) error {
+			return fmt.Errorf("%w: line %v: %v", ErrorMalformedPatch, n+1, why)
+		}
+
+		if oldLeft == 0 && newLeft == 0 {
+			switch {
+			case strings.HasPrefix(line, "@@ "):
+				from, oldLen, newLen, err := parseHunkHeader(line)
+				if err != nil {
+					return nil, malformed(err.Error())
+				}
+				hunks = append(hunks, unifiedHunk{from: from})
+				oldLeft, newLeft = oldLen, newLen
+				last = nil
+			case strings.HasPrefix(line, "\\") && len(hunks) > 0:
+				// Right after the last line of the hunk.
+				noNewline()
+			}
+			continue
+		}
+
+		h := &hunks[len(hunks)-1]
+		if line == "" {
+			return nil, malformed("hunk is truncated")
+		}
+		switch line[0] {
+		case ' ':
+			if oldLeft == 0 || newLeft == 0 {
+				return nil, malformed("more lines than in the hunk header")
+			}
+			h.old = append(h.old, line[1:])
+			h.new = append(h.new, line[1:])
+			oldLeft--
+			newLeft--
+			last = nil
+		case '-':
+			if oldLeft == 0 {
+				return nil, malformed("more lines than in the hunk header")
+			}
+			h.old = append(h.old, line[1:])
+			oldLeft--
+			last = &h.old
+		case '+':
+			if newLeft == 0 {
+				return nil, malformed("more lines than in the hunk header")
+			}
+			h.new = append(h.new, line[1:])
+			newLeft--
+			last = &h.new
+		case '\\':
+			noNewline()
+		default:
+			return nil, malformed("hunk is truncated")
+		}
+	}
+
+	if oldLeft > 0 || newLeft > 0 {
+		return nil, fmt.Errorf(
+			"%w: the last hunk is truncated",
+			ErrorMalformedPatch,
+		)
+	}
+	return hunks, nil
+}
+
+// Parses a hunk header like "@@ -1,3 +1,4 @@", returning the first line of the
+// old range and the lengths of both ranges, which are 1 if omitted.
+func parseHunkHeader(line string) (from, oldLen, newLen int, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[3] != "@@" ||
+		!strings.HasPrefix(fields[1], "-") ||
+		!strings.HasPrefix(fields[2], "+") {
+		return 0, 0, 0, errors.New("bad hunk header")
+	}
+
+	// Parses "start,length" or "start".
+	parseRange := func(r string) (int, int, error) {
+		start, length, found := strings.Cut(r, ",")
+		s, err := strconv.Atoi(start)
+		if err != nil || !found {
+			return s, 1, err
+		}
+		l, err := strconv.Atoi(length)
+		if err == nil && l < 0 {
+			err = errors.New("negative hunk length")
+		}
+		return s, l, err
+	}
+
+	from, oldLen, err = parseRange(fields[1][1:])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	_, newLen, err = parseRange(fields[2][1:])
+	return from, oldLen, newLen, err
+}
+
+// Removes the line terminator of the last line.
+func trimLastTerminator(lines []string) {
+	if len(lines) > 0 {
+		lines[len(lines)-1] = strings.TrimSuffix(lines[len(lines)-1], "\n")
+	}
+}
@@ -0,0 +1,60 @@
+package gopiecetable
+
+import (
+	"errors"
+	"sort"
+)
+
+// Returned when going to a revision that's not in the undo/redo list.
+var ErrorNoSuchRevision = errors.New("no such revision")
+
+// Revision returns the revision of the current state of the piece table. Every
+// edit made or extended yields a new revision, always greater than the
+// previous ones, so a revision identifies a single state. New piece tables
+// start at revision zero.
+func (b *PieceTable[Content]) Revision() uint64 {
+	return b.revisionAt(b.undoTop)
+}
+
+// GoTo undoes or redoes edits until the piece table is at the revision rev.
+// Returns ErrorNoSuchRevision, without changing the piece table, if rev is not
+// in the undo/redo list, i.e., if it was discarded or is the state in the
+// middle of an edit that was extended afterwards.
+func (b *PieceTable[Content]) GoTo(rev uint64) error {
+	top, ok := b.topOf(rev)
+	if !ok {
+		return ErrorNoSuchRevision
+	}
+
+	for b.undoTop > top {
+		b.UndoEdit()
+	}
+	for b.undoTop < top {
+		b.RedoEdit()
+	}
+	return nil
+}
+
+// Returns the undo top where the piece table is at the revision rev, if it's
+// in the undo/redo list.
+func (b *PieceTable[Content]) topOf(rev uint64) (int, bool) {
+	// The revisions increase along the list.
+	top := sort.Search(len(b.edits)+1, func(i int) bool {
+		return b.revisionAt(i) >= rev
+	})
+	return top, top <= len(b.edits) && b.revisionAt(top) == rev
+}
+
+// Returns the revision of the state when the undo top is at top.
+func (b *PieceTable[Content]) revisionAt(top int) uint64 {
+	if top == 0 {
+		return b.baseRevision
+	}
+	return b.edits[top-1].revision()
+}
+
+// Returns a new revision for an edit.
+func (b *PieceTable[Content]) nextRevision() uint64 {
+	b.lastRevision++
+	return b.lastRevision
+}
@@ -11,9 +11,8 @@ func String(b *PieceTable[rune]) string {
 		((len(b.buffers)-1)*b.bufferSize() +
 			b.buffers[0].size()) * 4)
 
-	for _, piece := range b.pieces {
-		content := b.pieceContent(piece)
-		for _, r := range content {
+	for s := range b.segments(0, b.size) {
+		for _, r := range s {
 			builder.WriteRune(r)
 		}
 	}
@@ -34,8 +33,9 @@ func String(b *PieceTable[rune]) string {
 // encoded as 2 or 3 byte runes. If using FromString with text consisting of
 // only these languages, you're guaranteed to have at least a two times overhead
 // for the first buffer.
-func FromString(content string) *PieceTable[rune] {
+func FromString(content string, opts ...Option) *PieceTable[rune] {
 	buffer := new(PieceTable[rune])
+	buffer.configure(opts)
 	buffer.buffers = make([]backingBuffer[rune], 2)
 
 	// We make Go alloc a sane amount of memory (may be up to 4x more than we
@@ -53,11 +53,14 @@ func FromString(content string) *PieceTable[rune] {
 		buffer.size++
 	}
 
-	buffer.pieces = append(buffer.pieces, piece{
-		buffer: 0,
-		start:  0,
-		length: buffer.buffers[0].size(),
-	})
+	// Empty pieces are never kept.
+	if buffer.size > 0 {
+		buffer.pieces = append(buffer.pieces, piece{
+			buffer: 0,
+			start:  0,
+			length: buffer.size,
+		})
+	}
 
 	return buffer
 }
@@ -0,0 +1,53 @@
+package gopiecetable
+
+import "iter"
+
+// Sequence is a sequence of items with undo/redo, implemented by PieceTable and
+// GapBuffer, so editors can swap them.
+type Sequence[Content any] interface {
+	// Get returns the item at the index idx.
+	Get(idx int) (Content, error)
+	// Size returns the amount of items.
+	Size() int
+	// Insert inserts the item at the index idx, which may be the size to
+	// append.
+	Insert(idx int, item Content) error
+	// Delete removes the item at the index idx.
+	Delete(idx int) error
+	// Undo undoes the last edit, returning where the cursor should be placed.
+	Undo() (int, error)
+	// Redo redoes the last edit undone, returning where the cursor should be
+	// placed.
+	Redo() (int, error)
+	// All iterates over the indexes and items, in order. The sequence must
+	// not be edited while iterating.
+	All() iter.Seq2[int, Content]
+}
+
+var (
+	_ Sequence[rune] = (*PieceTable[rune])(nil)
+	_ Sequence[rune] = (*GapBuffer[rune])(nil)
+)
+
+// All iterates over the indexes and items of the piece table, in order,
+// without copying them. The piece table must not be edited while iterating.
+func (b *PieceTable[Content]) All() iter.Seq2[int, Content] {
+	return func(yield func(int, Content) bool) {
+		idx := 0
+		for _, p := range b.pieces {
+			buf, disp := p.buffer, p.start
+			for range p.length {
+				// The piece may span the following buffers.
+				if disp >= b.buffers[buf].size() {
+					buf++
+					disp = 0
+				}
+				if !yield(idx, b.buffers[buf].content[disp]) {
+					return
+				}
+				idx++
+				disp++
+			}
+		}
+	}
+}
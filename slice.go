@@ -0,0 +1,118 @@
+package gopiecetable
+
+import (
+	"iter"
+	"strings"
+)
+
+// Returns the subslices of the buffers holding the items in [start, end), in
+// order, which must be in bounds when ranged. Pieces spanning buffers yield a
+// subslice for each buffer.
+func (b *PieceTable[Content]) segments(start, end int) iter.Seq[[]Content] {
+	return func(yield func([]Content) bool) {
+		if start == end {
+			return
+		}
+		// Found when ranged, as the pieces may have changed since.
+		pidx, disp, _ := b.findPieceWithIdx(start)
+		b.segmentsAt(pidx, disp, end-start)(yield)
+	}
+}
+
+// Same as segments, but for n items from the displacement disp of the piece
+// pidx, so the piece doesn't have to be found again.
+func (b *PieceTable[Content]) segmentsAt(
+	pidx int,
+	disp int,
+	n int,
+) iter.Seq[[]Content] {
+	return func(yield func([]Content) bool) {
+		pidx, disp := pidx, disp
+		for left := n; left > 0; pidx++ {
+			p := b.pieces[pidx]
+			m := min(p.length-disp, left)
+			left -= m
+
+			// Most pieces are in a single buffer.
+			start := p.start + disp
+			if c := b.buffers[p.buffer].content; start+m <= len(c) {
+				if !yield(c[start : start+m : start+m]) {
+					return
+				}
+				disp = 0
+				continue
+			}
+
+			buf, bdisp := b.indexByPiece(p, disp)
+			for m > 0 {
+				c := b.buffers[buf].content[bdisp:]
+				c = c[:min(len(c), m):min(len(c), m)]
+				if !yield(c) {
+					return
+				}
+				m -= len(c)
+				buf++
+				bdisp = 0
+			}
+			disp = 0
+		}
+	}
+}
+
+// Segments iterates over the items in [start, end), clamped to the bounds of
+// the piece table, without copying them: it yields the subslices of the
+// backing buffers holding them, in order, one for each piece, or more if the
+// piece spans buffers. The subslices must not be modified, and are only valid
+// until the piece table is edited. The piece table is read every time the
+// sequence is ranged, so it may be ranged again after edits, clamping the
+// bounds again.
+func (b *PieceTable[Content]) Segments(start, end int) iter.Seq[[]Content] {
+	return func(yield func([]Content) bool) {
+		start := min(max(start, 0), b.size)
+		end := min(max(end, start), b.size)
+		b.segments(start, end)(yield)
+	}
+}
+
+// Slice returns a copy of the items in [start, end).
+func (b *PieceTable[Content]) Slice(start, end int) ([]Content, error) {
+	if start < 0 || end < start || end > b.size {
+		return nil, ErrorOutOfBounds
+	}
+	return b.AppendSlice(make([]Content, 0, end-start), start, end)
+}
+
+// AppendSlice appends the items in [start, end) to dst and returns the
+// extended slice, so the same memory may be reused to read different parts of
+// the piece table.
+func (b *PieceTable[Content]) AppendSlice(
+	dst []Content,
+	start int,
+	end int,
+) ([]Content, error) {
+	if start < 0 || end < start || end > b.size {
+		return dst, ErrorOutOfBounds
+	}
+	for s := range b.segments(start, end) {
+		dst = append(dst, s...)
+	}
+	return dst, nil
+}
+
+// Substring returns the runes in [start, end) of a PieceTable[rune] as a
+// string.
+func Substring(b *PieceTable[rune], start, end int) (string, error) {
+	if start < 0 || end < start || end > b.size {
+		return "", ErrorOutOfBounds
+	}
+
+	var builder strings.Builder
+	// Enough if it's ASCII.
+	builder.Grow(end - start)
+	for s := range b.segments(start, end) {
+		for _, r := range s {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String(), nil
+}
@@ -0,0 +1,94 @@
+package gopiecetable
+
+import "slices"
+
+// Snapshot is an immutable view of the content of a piece table at some point.
+// It shares the buffers with the piece table, so taking one is cheap: only the
+// pieces are copied.
+type Snapshot[Content any] struct {
+	table   *PieceTable[Content]
+	epoch   int
+	buffers []backingBuffer[Content]
+	pieces  []piece
+	size    int
+}
+
+// Snapshot returns a snapshot of the current content of the piece table.
+func (b *PieceTable[Content]) Snapshot() Snapshot[Content] {
+	return Snapshot[Content]{
+		table:   b,
+		epoch:   b.epoch,
+		buffers: b.buffers,
+		pieces:  slices.Clone(b.pieces),
+		size:    b.size,
+	}
+}
+
+// SnapshotAt returns a snapshot of the content of the piece table at the
+// revision rev, without undoing or redoing anything. Returns
+// ErrorNoSuchRevision if rev is not in the undo/redo list.
+func (b *PieceTable[Content]) SnapshotAt(
+	rev uint64,
+) (Snapshot[Content], error) {
+	top, ok := b.topOf(rev)
+	if !ok {
+		return Snapshot[Content]{}, ErrorNoSuchRevision
+	}
+
+	s := b.Snapshot()
+	for i := b.undoTop - 1; i >= top; i-- {
+		c := b.edits[i].changes()
+		s.pieces = slices.Replace(
+			s.pieces,
+			c.piecIdx,
+			c.piecIdx+len(c.after),
+			c.before...,
+		)
+	}
+	for i := b.undoTop; i < top; i++ {
+		c := b.edits[i].changes()
+		s.pieces = slices.Replace(
+			s.pieces,
+			c.piecIdx,
+			c.piecIdx+len(c.before),
+			c.after...,
+		)
+	}
+
+	s.size = 0
+	for _, p := range s.pieces {
+		s.size += p.length
+	}
+	return s, nil
+}
+
+// Size returns the size of the snapshot.
+func (s Snapshot[Content]) Size() int {
+	return s.size
+}
+
+// Content returns the content of the snapshot as a slice.
+func (s Snapshot[Content]) Content() []Content {
+	view := s.view()
+	content := make([]Content, 0, s.size)
+	for segment := range view.segments(0, s.size) {
+		content = append(content, segment...)
+	}
+	return content
+}
+
+// Returns a piece table with the snapshot buffers and pieces, to read them.
+// Must not be edited.
+func (s Snapshot[Content]) view() *PieceTable[Content] {
+	return &PieceTable[Content]{
+		buffers: s.buffers,
+		pieces:  s.pieces,
+		size:    s.size,
+	}
+}
+
+// Returns wether the pieces of both snapshots point to the same buffers, i.e.,
+// wether equal pieces mean equal content.
+func (s Snapshot[Content]) sharesBuffers(other Snapshot[Content]) bool {
+	return s.table != nil && s.table == other.table && s.epoch == other.epoch
+}
@@ -3,6 +3,7 @@ package gopiecetable
 import (
 	"errors"
 	"slices"
+	"time"
 )
 
 // Returned when there's nothing left to undo.
@@ -11,184 +12,472 @@ var ErrorBottomOfUndoList = errors.New("reached bottom of undo list")
 // Returned when there's nothing left to redo.
 var ErrorTopOfUndoList = errors.New("reached top of undo list")
 
+// EditKind tells what an edit did to the piece table.
+type EditKind int
+
+const (
+	// The edit inserted items.
+	KindInsertion EditKind = iota
+	// The edit deleted items.
+	KindDeletion
+	// The edit is a group of insertions and deletions.
+	KindCompound
+)
+
+// EditInfo describes the range affected by undoing or redoing an edit: the
+// items in [Start, Start+Removed) were replaced by Inserted items. For compound
+// edits, it's the smallest range containing every change.
+type EditInfo struct {
+	Kind     EditKind // The kind of the edit undone or redone.
+	Start    int      // The first index affected.
+	Removed  int      // The amount of items removed from Start.
+	Inserted int      // The amount of items inserted at Start.
+	// The cursor state set with SetCursorState: the one before the edit when
+	// undoing and the one after it when redoing. Nil if never set.
+	CursorState any
+}
+
+// End returns the index right after the inserted items, i.e., where a cursor
+// should be placed after undoing or redoing.
+func (e EditInfo) End() int {
+	return e.Start + e.Inserted
+}
+
+// Returns the info of undoing an edit that did e.
+func (e EditInfo) inverse() EditInfo {
+	e.Removed, e.Inserted = e.Inserted, e.Removed
+	return e
+}
+
 // Represents an edit.
 type edit interface {
-	undoIndex() int
-	redoIndex() int
+	// The info of redoing the edit.
+	info() EditInfo
+	changes() span
+	// Returns the edit with the span replaced. The span of an edit is never
+	// modified in place, as it may be shared with clones of the piece table.
+	withChanges(s span) edit
+	items() int
+	lastChanged() time.Time
+	cursor() cursorStates
+	withCursor(c cursorStates) edit
+	// The revision of the piece table after the edit. Changes every time the
+	// edit is made or extended.
+	revision() uint64
+}
+
+// The cursor states set by the user around an edit.
+type cursorStates struct {
+	before any // The state when the edit was made.
+	after  any // The first state set after the edit was made or extended.
+}
+
+// The pieces an edit replaced and the pieces it replaced them with. Undoing and
+// redoing swaps one for the other, so the piece array is restored exactly as it
+// was and the piecIdx of older edits stays valid.
+type span struct {
+	piecIdx int     // The index of the first piece in the pieces array.
+	before  []piece // The pieces before the edit.
+	after   []piece // The pieces after the edit.
 }
 
 // Represents an insertion, implements edit.
 type insertion struct {
-	idx     int   // The real index.
-	piecIdx int   // The index in the piece array.
-	piec    piece // The piece itself.
+	idx    int       // The real index.
+	length int       // The total length inserted.
+	time   time.Time // When it was last extended.
+	states cursorStates
+	rev    uint64
+	span
+}
+
+func (i insertion) info() EditInfo {
+	return EditInfo{Kind: KindInsertion, Start: i.idx, Inserted: i.length}
+}
+
+func (i insertion) changes() span {
+	return i.span
+}
+
+func (i insertion) withChanges(s span) edit {
+	i.span = s
+	return i
+}
+
+func (i insertion) items() int {
+	return i.length
 }
 
-func (i insertion) undoIndex() int {
-	return i.idx
+func (i insertion) lastChanged() time.Time {
+	return i.time
 }
 
-func (i insertion) redoIndex() int {
-	return i.idx + i.piec.length
+func (i insertion) cursor() cursorStates {
+	return i.states
+}
+
+func (i insertion) withCursor(c cursorStates) edit {
+	i.states = c
+	return i
+}
+
+func (i insertion) revision() uint64 {
+	return i.rev
 }
 
 // Represents a deletion, implements edit.
 type deletion struct {
-	idx     int     // The real index.
-	piecIdx int     // The index in the pieces array.
-	length  int     // The total length deleted.
-	pieces  []piece // The pieces deleted.
+	idx    int       // The real index.
+	length int       // The total length deleted.
+	time   time.Time // When it was last extended.
+	states cursorStates
+	rev    uint64
+	span
+}
+
+func (d deletion) info() EditInfo {
+	return EditInfo{Kind: KindDeletion, Start: d.idx, Removed: d.length}
+}
+
+func (d deletion) changes() span {
+	return d.span
+}
+
+func (d deletion) withChanges(s span) edit {
+	d.span = s
+	return d
+}
+
+func (d deletion) items() int {
+	return d.length
 }
 
-func (d deletion) undoIndex() int {
-	return d.idx + d.length
+func (d deletion) lastChanged() time.Time {
+	return d.time
 }
 
-func (d deletion) redoIndex() int {
-	return d.idx
+func (d deletion) cursor() cursorStates {
+	return d.states
 }
 
-// Undoes the last edit.
+func (d deletion) withCursor(c cursorStates) edit {
+	d.states = c
+	return d
+}
+
+func (d deletion) revision() uint64 {
+	return d.rev
+}
+
+// Undoes the last edit. Returns the index where the cursor should be placed,
+// see UndoEdit for the whole range affected.
 func (b *PieceTable[Content]) Undo() (int, error) {
+	info, err := b.UndoEdit()
+	return info.End(), err
+}
+
+// Redoes the last edit, if the last action was an undo. Returns the index where
+// the cursor should be placed, see RedoEdit for the whole range affected.
+func (b *PieceTable[Content]) Redo() (int, error) {
+	info, err := b.RedoEdit()
+	return info.End(), err
+}
+
+// UndoEdit undoes the last edit, returning the range it affected.
+func (b *PieceTable[Content]) UndoEdit() (EditInfo, error) {
 	if b.undoTop < 1 {
-		return 0, ErrorBottomOfUndoList
+		b.record(Call[Content]{Kind: CallUndo}, ErrorBottomOfUndoList)
+		return EditInfo{}, ErrorBottomOfUndoList
 	}
 
 	b.undoTop--
 	edit := b.edits[b.undoTop]
 	b.undo(edit)
-	return edit.undoIndex(), nil
+
+	b.coalescing = false
+	info := edit.info().inverse()
+	info.CursorState = edit.cursor().before
+	b.cursorState = info.CursorState
+	b.awaitingCursor = false
+	b.record(Call[Content]{Kind: CallUndo, Result: info.End()}, nil)
+	return info, nil
 }
 
-// Redoes the last edit, if the last action was an undo.
-func (b *PieceTable[Content]) Redo() (int, error) {
+// RedoEdit redoes the last edit, if the last action was an undo, returning the
+// range it affected.
+func (b *PieceTable[Content]) RedoEdit() (EditInfo, error) {
 	if b.undoTop == len(b.edits) {
-		return 0, ErrorTopOfUndoList
+		b.record(Call[Content]{Kind: CallRedo}, ErrorTopOfUndoList)
+		return EditInfo{}, ErrorTopOfUndoList
 	}
 
 	b.undoTop++
 	edit := b.edits[b.undoTop-1]
 	b.redo(edit)
-	return edit.redoIndex(), nil
+
+	b.coalescing = false
+	info := edit.info()
+	info.CursorState = edit.cursor().after
+	b.cursorState = info.CursorState
+	b.awaitingCursor = false
+	b.record(Call[Content]{Kind: CallRedo, Result: info.End()}, nil)
+	return info, nil
 }
 
-// Ugly. Should be part of the interface, but methods cannot have type
-// parameters.
-func (b *PieceTable[Content]) undo(e edit) {
-	switch ed := e.(type) {
-	case insertion:
-		b.undoInsertion(ed)
-	case deletion:
-		b.undoDeletion(ed)
+// SetCursorState sets an opaque state, such as the cursor and selection
+// positions, to be stored with the edits. Each edit stores the state set before
+// it was made and the first one set after it, and UndoEdit and RedoEdit return
+// them so the state can be restored. Therefore, SetCursorState should be called
+// every time the state changes, including right after each edit.
+func (b *PieceTable[Content]) SetCursorState(state any) {
+	b.cursorState = state
+	if b.awaitingCursor && b.undoTop > 0 {
+		e := b.edits[b.undoTop-1]
+		c := e.cursor()
+		c.after = state
+		b.edits[b.undoTop-1] = e.withCursor(c)
 	}
+	b.awaitingCursor = false
 }
 
-// Ugly. Should be part of the interface, but methods cannot have type
-// parameters.
-func (b *PieceTable[Content]) redo(e edit) {
-	switch ed := e.(type) {
-	case insertion:
-		b.redoInsertion(ed)
-	case deletion:
-		b.redoDeletion(ed)
+// TrimHistory discards the oldest edits so that at most n remain in the
+// undo/redo list. If that's not enough because the piece table was undone
+// below the edits that would be kept, the edits that could be redone are
+// discarded, newest first. Call Compact afterwards to release the memory used
+// by the content the discarded edits referenced.
+func (b *PieceTable[Content]) TrimHistory(n int) {
+	n = max(n, 0)
+	if len(b.edits) <= n {
+		return
 	}
+
+	b.dropOldest(len(b.edits) - n)
+	b.truncateEdits(n)
+	b.record(Call[Content]{Kind: CallTrim, Index: n}, nil)
 }
 
-func (b *PieceTable[Content]) undoInsertion(i insertion) {
-	piec := b.pieces[i.piecIdx]
-	b.pieces = slices.Delete(b.pieces, i.piecIdx, i.piecIdx+1)
-	b.size -= piec.length
+// Discards up to n edits from the bottom of the undo/redo list, never going
+// above the current edit. Returns the amount discarded.
+func (b *PieceTable[Content]) dropOldest(n int) int {
+	n = max(min(n, b.undoTop), 0)
+	for _, e := range b.edits[:n] {
+		b.discarded += e.items()
+	}
+	for _, e := range b.edits[:n] {
+		b.editedItems -= e.items()
+	}
+	if n > 0 {
+		b.baseRevision = b.edits[n-1].revision()
+	}
+	b.undoTop -= n
+
+	// Resliced, so dropping is cheap even if it happens on every edit. The
+	// dropped edits are cleared so their pieces may be collected, and the
+	// list is only copied once they take more room than the ones left.
+	clear(b.edits[:n])
+	b.edits = b.edits[n:]
+	b.droppedEdits += n
+	if b.droppedEdits > len(b.edits) {
+		b.edits = slices.Clone(b.edits)
+		b.droppedEdits = 0
+	}
+	return n
 }
 
-func (b *PieceTable[Content]) redoInsertion(i insertion) {
-	b.pieces = slices.Insert(b.pieces, i.piecIdx, i.piec)
-	b.size += i.piec.length
+// Discards the edits from n onwards, which must be above the current edit.
+func (b *PieceTable[Content]) truncateEdits(n int) {
+	for _, e := range b.edits[n:] {
+		b.discarded += e.items()
+		b.editedItems -= e.items()
+	}
+	clear(b.edits[n:])
+	b.edits = b.edits[:n]
 }
 
-func (b *PieceTable[Content]) undoDeletion(d deletion) {
-	for i, p := range d.pieces {
-		b.pieces = slices.Insert(b.pieces, d.piecIdx+i, p)
+// Enforces the limits set by the options. Should be called every time an edit
+// is pushed or extended.
+func (b *PieceTable[Content]) limitHistory() {
+	if b.options.maxEdits > 0 && len(b.edits) > b.options.maxEdits {
+		b.dropOldest(len(b.edits) - b.options.maxEdits)
+	}
+
+	if b.options.maxEditedItems > 0 {
+		items := b.editedItems
+		n := 0
+		for ; items > b.options.maxEditedItems && n < len(b.edits); n++ {
+			items -= b.edits[n].items()
+		}
+		b.dropOldest(n)
+	}
+
+	// When replaying, the edits are discarded as recorded instead.
+	if b.options.maxAge > 0 && b.replaying == nil {
+		n := 0
+		for n < len(b.edits) &&
+			time.Since(b.edits[n].lastChanged()) > b.options.maxAge {
+			n++
+		}
+		b.aged += b.dropOldest(n)
+	}
+
+	if b.options.autoCompact > 0 && b.discarded >= b.options.autoCompact {
+		b.Compact()
 	}
-	b.size += d.length
 }
 
-func (b *PieceTable[Content]) redoDeletion(d deletion) {
-	// We're guaranteed to have exactly the same pieces at the point of the
-	// buffer.
-	b.pieces = slices.Delete(b.pieces, d.piecIdx, d.piecIdx+len(d.pieces))
+func (b *PieceTable[Content]) undo(e edit) {
+	s := e.changes()
+	b.pieces = slices.Replace(
+		b.pieces,
+		s.piecIdx,
+		s.piecIdx+len(s.after),
+		s.before...,
+	)
+	info := e.info()
+	b.size -= info.Inserted - info.Removed
+}
+
+func (b *PieceTable[Content]) redo(e edit) {
+	s := e.changes()
+	b.pieces = slices.Replace(
+		b.pieces,
+		s.piecIdx,
+		s.piecIdx+len(s.before),
+		s.after...,
+	)
+	info := e.info()
+	b.size += info.Inserted - info.Removed
 }
 
 // Should be called every action that's not an undo or redo so the list is
 // wrapped.
 func (b *PieceTable[Content]) normalizeUndo() {
-	b.edits = b.edits[:b.undoTop]
-}
-
-func (b *PieceTable[Content]) pushInsertion(idx int, piecIdx int, piec piece) {
-	e := insertion{idx: idx, piecIdx: piecIdx, piec: piec}
-	b.edits = append(b.edits, e)
-	b.undoTop = len(b.edits)
+	b.truncateEdits(b.undoTop)
 }
 
-func (b *PieceTable[Content]) extendInsertion() {
-	i, _ := b.edits[b.undoTop-1].(insertion)
-	i.piec.length++
-	b.edits[b.undoTop-1] = i
+// Returns the span of an edit that replaced the pieces before with the pieces
+// now in the range [piecIdx, piecIdx+length).
+func (b *PieceTable[Content]) spanOf(
+	piecIdx int,
+	length int,
+	before []piece,
+) span {
+	return span{
+		piecIdx: piecIdx,
+		before:  before,
+		after:   slices.Clone(b.pieces[piecIdx : piecIdx+length]),
+	}
 }
 
-func (b *PieceTable[Content]) lastIsInsertion() bool {
-	if b.undoTop == 0 {
-		return false
+// Merges the span of the last edit with the span of the edit just applied,
+// yielding a span that goes straight from the state before the first to the
+// current one. Both must be in the coordinates of the pieces array between
+// the two edits.
+func (b *PieceTable[Content]) mergeSpans(prev, next span) span {
+	// Given an index in the pieces array between the two edits, returns the
+	// piece there.
+	delta := len(next.after) - len(next.before)
+	between := func(i int) piece {
+		switch {
+		case i < next.piecIdx:
+			return b.pieces[i]
+		case i < next.piecIdx+len(next.before):
+			return next.before[i-next.piecIdx]
+		default:
+			return b.pieces[i+delta]
+		}
 	}
-	_, is := b.edits[b.undoTop-1].(insertion)
-	return is
-}
 
-func (b *PieceTable[Content]) lastIsDeletion() bool {
-	if b.undoTop == 0 {
-		return false
+	start := min(prev.piecIdx, next.piecIdx)
+	end := max(
+		prev.piecIdx+len(prev.after),
+		next.piecIdx+len(next.before),
+	)
+
+	before := make([]piece, 0, end-start-len(prev.after)+len(prev.before))
+	for i := start; i < prev.piecIdx; i++ {
+		before = append(before, between(i))
+	}
+	before = append(before, prev.before...)
+	for i := prev.piecIdx + len(prev.after); i < end; i++ {
+		before = append(before, between(i))
 	}
-	_, is := b.edits[b.undoTop-1].(deletion)
-	return is
-}
 
-func (b *PieceTable[Content]) lastDeletionIdx() int {
-	d, _ := b.edits[b.undoTop-1].(deletion)
-	return d.idx
+	return span{
+		piecIdx: start,
+		before:  before,
+		after:   slices.Clone(b.pieces[start : end+delta]),
+	}
 }
 
-func (b *PieceTable[Content]) undoRedoManageDeletion(
+func (b *PieceTable[Content]) undoRedoManageInsertion(
 	idx int,
-	piecIdx int,
-	p piece,
+	r Content,
+	s span,
 ) {
-	if b.lastIsDeletion() {
-		ei := b.lastDeletionIdx()
-		if ei-1 == idx {
-			b.undoRedoAddDeletionPiece(idx, p, piecIdx)
-			return
-		}
+	defer b.limitHistory()
+
+	coalesces := b.coalesces(KindInsertion, idx, r)
+	b.merged = coalesces
+	b.editedItems++
+	b.lastItem = r
+	b.coalescing = true
+	b.awaitingCursor = true
+
+	if coalesces {
+		i, _ := b.edits[b.undoTop-1].(insertion)
+		i.length++
+		i.time = time.Now()
+		i.span = b.mergeSpans(i.span, s)
+		i.rev = b.nextRevision()
+		b.edits[b.undoTop-1] = i
+		return
 	}
-	b.edits = append(b.edits, deletion{
-		idx:     idx,
-		piecIdx: piecIdx,
-		pieces:  []piece{p},
-		length:  p.length,
+
+	b.edits = append(b.edits, insertion{
+		idx:    idx,
+		length: 1,
+		time:   time.Now(),
+		states: cursorStates{before: b.cursorState},
+		rev:    b.nextRevision(),
+		span:   s,
 	})
 	b.undoTop++
 }
 
-func (b *PieceTable[Content]) undoRedoAddDeletionPiece(
+func (b *PieceTable[Content]) undoRedoManageDeletion(
 	idx int,
-	p piece,
-	piecIdx int,
+	r Content,
+	s span,
 ) {
-	d, _ := b.edits[b.undoTop-1].(deletion)
-	d.pieces = slices.Insert(d.pieces, 0, p)
-	// Possibly merge the pieces.
-	d.pieces = b.tryMergePieces(0, 1, d.pieces)
-	d.piecIdx = piecIdx
-	d.length += p.length
-	d.idx = idx
-	b.edits[b.undoTop-1] = d
+	defer b.limitHistory()
+
+	coalesces := b.coalesces(KindDeletion, idx, r)
+	b.merged = coalesces
+	b.editedItems++
+	b.lastItem = r
+	b.coalescing = true
+	b.awaitingCursor = true
+
+	if coalesces {
+		d, _ := b.edits[b.undoTop-1].(deletion)
+		d.span = b.mergeSpans(d.span, s)
+		d.length++
+		// If deleting backwards.
+		d.idx = min(d.idx, idx)
+		d.time = time.Now()
+		d.rev = b.nextRevision()
+		b.edits[b.undoTop-1] = d
+		return
+	}
+
+	b.edits = append(b.edits, deletion{
+		idx:    idx,
+		length: 1,
+		time:   time.Now(),
+		states: cursorStates{before: b.cursorState},
+		rev:    b.nextRevision(),
+		span:   s,
+	})
+	b.undoTop++
 }
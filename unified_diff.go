@@ -0,0 +1,124 @@
+package gopiecetable
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// UnifiedDiff returns the difference between the snapshots a and b of piece
+// tables of runes in the unified format, naming them nameA and nameB and
+// showing context unchanged lines around each hunk. Returns an empty string if
+// they have the same content.
+//
+// Like Diff, regions where the snapshots share the pieces are skipped, and the
+// remaining lines are diffed with the Myers algorithm.
+func UnifiedDiff(a, b Snapshot[rune], nameA, nameB string, context int) string {
+	aText, bText := a.Content(), b.Content()
+	prefix, suffix := sharedAffixes(a, b)
+
+	// The shared regions may end in the middle of lines, so we only skip the
+	// whole lines inside them.
+	start := prefix
+	for start > 0 && aText[start-1] != '\n' {
+		start--
+	}
+	aEnd, bEnd := len(aText), len(bText)
+	if suffix > 0 {
+		from := len(aText) - suffix
+		if i := slices.Index(aText[from:], '\n'); i >= 0 {
+			aEnd = from + i + 1
+			bEnd = len(bText) - suffix + i + 1
+		}
+	}
+
+	skipped := strings.Count(string(aText[:start]), "\n")
+	hunks := myers(
+		splitLines(aText[start:aEnd]),
+		splitLines(bText[start:bEnd]),
+	)
+	if len(hunks) == 0 {
+		return ""
+	}
+	for i := range hunks {
+		hunks[i].AStart += skipped
+		hunks[i].BStart += skipped
+	}
+
+	aLines, bLines := splitLines(aText), splitLines(bText)
+	context = max(context, 0)
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "--- %v\n+++ %v\n", nameA, nameB)
+
+	for len(hunks) > 0 {
+		// Hunks closer than two contexts are shown together.
+		n := 1
+		for n < len(hunks) &&
+			hunks[n].AStart-(hunks[n-1].AStart+hunks[n-1].ALength) <=
+				2*context {
+			n++
+		}
+		group := hunks[:n]
+		hunks = hunks[n:]
+
+		first, last := group[0], group[len(group)-1]
+		aFrom := max(first.AStart-context, 0)
+		bFrom := first.BStart - (first.AStart - aFrom)
+		aTo := min(last.AStart+last.ALength+context, len(aLines))
+		bTo := last.BStart + last.BLength + (aTo - last.AStart - last.ALength)
+
+		fmt.Fprintf(
+			&builder,
+			"@@ -%v +%v @@\n",
+			unifiedRange(aFrom, aTo-aFrom),
+			unifiedRange(bFrom, bTo-bFrom),
+		)
+
+		pos := aFrom
+		for _, h := range group {
+			removed := aLines[h.AStart : h.AStart+h.ALength]
+			inserted := bLines[h.BStart : h.BStart+h.BLength]
+			writeUnifiedLines(&builder, ' ', aLines[pos:h.AStart])
+			writeUnifiedLines(&builder, '-', removed)
+			writeUnifiedLines(&builder, '+', inserted)
+			pos = h.AStart + h.ALength
+		}
+		writeUnifiedLines(&builder, ' ', aLines[pos:aTo])
+	}
+
+	return builder.String()
+}
+
+// Splits the text in lines, keeping the line terminators.
+func splitLines(text []rune) []string {
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Formats the range of lines [from, from+length) as in the hunk headers.
+func unifiedRange(from, length int) string {
+	switch length {
+	case 0:
+		// Empty ranges refer to the line before them.
+		return fmt.Sprintf("%v,0", from)
+	case 1:
+		return fmt.Sprint(from + 1)
+	default:
+		return fmt.Sprintf("%v,%v", from+1, length)
+	}
+}
+
+// Writes each line preceded by the mark.
+func writeUnifiedLines(builder *strings.Builder, mark rune, lines []string) {
+	for _, line := range lines {
+		builder.WriteRune(mark)
+		builder.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			builder.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package gopiecetable
+
+import "fmt"
+
+// Checks the internal invariants of the piece table, returning an error
+// describing the first one that doesn't hold. Meant for testing, as it walks
+// the entire piece array.
+func (b *PieceTable[Content]) validate() error {
+	size := 0
+	for i, p := range b.pieces {
+		if p.length <= 0 {
+			return fmt.Errorf("piece %v has length %v", i, p.length)
+		}
+		if p.buffer < 0 || p.buffer >= len(b.buffers) {
+			return fmt.Errorf("piece %v points to buffer %v", i, p.buffer)
+		}
+		if p.start < 0 || p.start >= b.buffers[p.buffer].size() {
+			return fmt.Errorf(
+				"piece %v starts at %v of buffer %v (size %v)",
+				i,
+				p.start,
+				p.buffer,
+				b.buffers[p.buffer].size(),
+			)
+		}
+
+		// The piece may span the following buffers.
+		available := b.buffers[p.buffer].size() - p.start
+		for buf := p.buffer + 1; buf < len(b.buffers); buf++ {
+			available += b.buffers[buf].size()
+		}
+		if p.length > available {
+			return fmt.Errorf(
+				"piece %v overflows the buffers by %v items",
+				i,
+				p.length-available,
+			)
+		}
+
+		if i > 0 && b.contiguous(b.pieces[i-1], p) {
+			return fmt.Errorf("pieces %v and %v were not merged", i-1, i)
+		}
+
+		size += p.length
+	}
+
+	if size != b.size {
+		return fmt.Errorf(
+			"size cache is %v but pieces add up to %v",
+			b.size,
+			size,
+		)
+	}
+
+	if b.undoTop < 0 || b.undoTop > len(b.edits) {
+		return fmt.Errorf(
+			"undo top is %v with %v edits",
+			b.undoTop,
+			len(b.edits),
+		)
+	}
+
+	items := 0
+	for _, e := range b.edits {
+		items += e.items()
+	}
+	if items != b.editedItems {
+		return fmt.Errorf(
+			"edited items cache is %v but edits add up to %v",
+			b.editedItems,
+			items,
+		)
+	}
+
+	// The last edit must have left its pieces in place, and the next one to
+	// redo must find the pieces it replaced.
+	if b.undoTop > 0 {
+		s := b.edits[b.undoTop-1].changes()
+		if !b.hasPiecesAt(s.piecIdx, s.after) {
+			return fmt.Errorf(
+				"edit %v does not match the pieces at %v",
+				b.undoTop-1,
+				s.piecIdx,
+			)
+		}
+	}
+	if b.undoTop < len(b.edits) {
+		s := b.edits[b.undoTop].changes()
+		if !b.hasPiecesAt(s.piecIdx, s.before) {
+			return fmt.Errorf(
+				"edit %v does not match the pieces at %v",
+				b.undoTop,
+				s.piecIdx,
+			)
+		}
+	}
+
+	return nil
+}
+
+// Returns wether the pieces array has exactly the given pieces starting at
+// piecIdx.
+func (b *PieceTable[Content]) hasPiecesAt(piecIdx int, pieces []piece) bool {
+	if piecIdx < 0 || piecIdx+len(pieces) > len(b.pieces) {
+		return false
+	}
+	for i, p := range pieces {
+		if b.pieces[piecIdx+i] != p {
+			return false
+		}
+	}
+	return true
+}